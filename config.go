@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/srivatsa-bot/bt-p2p/p2p"
+)
+
+// network settings from the config file, BT_* environment variables override them and flags override both
+//
+//	{
+//	  "bootstrap": ["/ip4/10.0.0.5/tcp/4001/p2p/12D3KooW..."],
+//	  "dht_prefix": "/acme",
+//	  "listen": ["/ip4/0.0.0.0/tcp/4001"],
+//	  "swarm_key": "/etc/bt/swarm.key",
+//	  "mdns": false,
+//	  "acl": "/etc/bt/acl.json"
+//	}
+type config struct {
+	Bootstrap []string `json:"bootstrap,omitempty"`  // "none" for no bootstrap peers at all
+	DHTPrefix string   `json:"dht_prefix,omitempty"` // private DHT apart from the IPFS one
+	Listen    []string `json:"listen,omitempty"`
+	SwarmKey  string   `json:"swarm_key,omitempty"` // private network key file, the default one is used when it exists
+	MDNS      *bool    `json:"mdns,omitempty"`      // local network discovery, on unless set to false
+	ACL       string   `json:"acl,omitempty"`       // allow and deny lists of peers, the default file is used when it exists
+}
+
+// Default location of the config file, next to the identity key
+func defaultConfigPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find config directory: %w", err)
+	}
+	return filepath.Join(dir, "bt", "config.json"), nil
+}
+
+// loadConfig reads the config file at path, BT_CONFIG or the default location.
+// Without a config file the defaults are used, a file named on purpose has to exist
+func loadConfig(path string) (config, error) {
+	var cfg config
+	named := path != ""
+	if !named {
+		path = os.Getenv("BT_CONFIG")
+		named = path != ""
+	}
+	if !named {
+		var err error
+		if path, err = defaultConfigPath(); err != nil {
+			return cfg, err
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !named {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read config: %w", err)
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// environment variables override the file, lists are comma or space separated
+func (c *config) applyEnv() error {
+	if v := os.Getenv("BT_BOOTSTRAP"); v != "" {
+		c.Bootstrap = splitList(v)
+	}
+	if v := os.Getenv("BT_DHT_PREFIX"); v != "" {
+		c.DHTPrefix = v
+	}
+	if v := os.Getenv("BT_LISTEN"); v != "" {
+		c.Listen = splitList(v)
+	}
+	if v := os.Getenv("BT_SWARM_KEY"); v != "" {
+		c.SwarmKey = v
+	}
+	if v := os.Getenv("BT_ACL"); v != "" {
+		c.ACL = v
+	}
+	if v := os.Getenv("BT_MDNS"); v != "" {
+		on, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid BT_MDNS %q: %w", v, err)
+		}
+		c.MDNS = &on
+	}
+	return nil
+}
+
+func (c config) mdnsEnabled() bool {
+	return c.MDNS == nil || *c.MDNS
+}
+
+// hostOptions turns the settings into options for CreateHost, the identity is added by the caller
+func (c config) hostOptions() (p2p.HostOptions, error) {
+	opts := p2p.HostOptions{
+		Listen:    c.Listen,
+		DHTPrefix: protocol.ID(c.DHTPrefix),
+	}
+	switch {
+	case c.Bootstrap != nil && len(c.Bootstrap) == 0, len(c.Bootstrap) == 1 && c.Bootstrap[0] == "none":
+		opts.Bootstrap = []peer.AddrInfo{}
+	case c.Bootstrap != nil:
+		peers, err := p2p.ParseBootstrapPeers(c.Bootstrap)
+		if err != nil {
+			return opts, err
+		}
+		opts.Bootstrap = peers
+	}
+
+	// a file named anywhere has to exist, the ones in the default location are optional
+	path, err := optionalFile(c.SwarmKey, p2p.DefaultSwarmKeyPath)
+	if err != nil {
+		return opts, err
+	}
+	if path != "" {
+		if opts.PSK, err = p2p.LoadSwarmKey(path); err != nil {
+			return opts, err
+		}
+	}
+
+	path, err = optionalFile(c.ACL, p2p.DefaultACLPath)
+	if err != nil {
+		return opts, err
+	}
+	if path != "" {
+		if opts.ACL, err = p2p.LoadACL(path); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+// optionalFile returns path when set, else the default path when that file exists and "" when it does not
+func optionalFile(path string, defaultPath func() (string, error)) (string, error) {
+	if path != "" {
+		return path, nil
+	}
+	path, err := defaultPath()
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return "", nil
+	}
+	return path, nil
+}
+
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+}
+
+// flag that can be given more than once, each value may hold several comma separated items
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, splitList(v)...)
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+const (
+	fileBootstrap = "/ip4/10.0.0.1/tcp/4001/p2p/QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN"
+	envBootstrap  = "/ip4/10.0.0.2/tcp/4001/p2p/QmQCU2EcMqAqQPR2i9bChDtGNJchTbq5TbXJJ16u19uLTa"
+	flagBootstrap = "/ip4/10.0.0.3/tcp/4001/p2p/QmbLHAnMoJPWSCR5Zhtx6BHJX9KiKNN6tpvbUcqanj75Nb"
+)
+
+// settings for the args, with a config file holding fileCfg and the environment in env.
+// the user config directory is empty so no default file is picked up
+func testSettings(t *testing.T, fileCfg string, env map[string]string, args ...string) config {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("BT_CONFIG", "")
+	for _, name := range []string{"BT_BOOTSTRAP", "BT_DHT_PREFIX", "BT_LISTEN", "BT_SWARM_KEY", "BT_ACL", "BT_MDNS"} {
+		t.Setenv(name, env[name])
+	}
+	if fileCfg != "" {
+		path := filepath.Join(dir, "config.json")
+		if err := os.WriteFile(path, []byte(fileCfg), 0644); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("BT_CONFIG", path)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	hf := addHostFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return hf.settings()
+}
+
+func TestConfigBootstrapPrecedence(t *testing.T) {
+	file := `{"bootstrap": ["` + fileBootstrap + `"], "dht_prefix": "/file", "mdns": false}`
+	env := map[string]string{"BT_BOOTSTRAP": envBootstrap, "BT_DHT_PREFIX": "/env"}
+
+	tests := []struct {
+		name      string
+		file      string
+		env       map[string]string
+		args      []string
+		bootstrap []string
+		prefix    string
+		mdns      bool
+	}{
+		{"defaults", "", nil, nil, nil, "", true},
+		{"file", file, nil, nil, []string{fileBootstrap}, "/file", false},
+		{"env over file", file, env, nil, []string{envBootstrap}, "/env", false},
+		{"flag over env", file, env, []string{"-bootstrap", flagBootstrap, "-dht-prefix", "/flag", "-mdns"}, []string{flagBootstrap}, "/flag", true},
+		{"flag over file", file, nil, []string{"-bootstrap", flagBootstrap + "," + envBootstrap}, []string{flagBootstrap, envBootstrap}, "/file", false},
+		{"env list", "", map[string]string{"BT_BOOTSTRAP": envBootstrap + " " + fileBootstrap, "BT_MDNS": "false"}, nil, []string{envBootstrap, fileBootstrap}, "", false},
+		{"none", file, map[string]string{"BT_BOOTSTRAP": "none"}, nil, []string{"none"}, "/file", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testSettings(t, tt.file, tt.env, tt.args...)
+			if !slices.Equal(cfg.Bootstrap, tt.bootstrap) {
+				t.Errorf("bootstrap %v, want %v", cfg.Bootstrap, tt.bootstrap)
+			}
+			if cfg.DHTPrefix != tt.prefix {
+				t.Errorf("dht prefix %q, want %q", cfg.DHTPrefix, tt.prefix)
+			}
+			if cfg.mdnsEnabled() != tt.mdns {
+				t.Errorf("mdns %v, want %v", cfg.mdnsEnabled(), tt.mdns)
+			}
+
+			// and the peers the host is started with
+			opts, err := cfg.hostOptions()
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case tt.bootstrap == nil:
+				if opts.Bootstrap != nil {
+					t.Errorf("got %d bootstrap peers, want the defaults", len(opts.Bootstrap))
+				}
+			case tt.bootstrap[0] == "none":
+				if opts.Bootstrap == nil || len(opts.Bootstrap) != 0 {
+					t.Errorf("got bootstrap peers %v, want none", opts.Bootstrap)
+				}
+			case len(opts.Bootstrap) != len(tt.bootstrap):
+				t.Errorf("got %d bootstrap peers, want %d", len(opts.Bootstrap), len(tt.bootstrap))
+			}
+		})
+	}
+}
+
+func TestConfigNamedFileMustExist(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("BT_CONFIG", "")
+	if _, err := loadConfig(""); err != nil {
+		t.Fatalf("missing default config: %v", err)
+	}
+	t.Setenv("BT_CONFIG", filepath.Join(t.TempDir(), "missing.json"))
+	if _, err := loadConfig(""); err == nil {
+		t.Fatal("missing config named in BT_CONFIG was accepted")
+	}
+}
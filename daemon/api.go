@@ -0,0 +1,184 @@
+// control api of a running node. bt daemon serves it as http/json on a unix socket,
+// the seed and download commands talk to it when a daemon is running and run a node in process otherwise
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/srivatsa-bot/bt-p2p/p2p"
+)
+
+// returned for a download or seed id the node does not know
+var ErrNotFound = errors.New("not found")
+
+// returned for a control socket another user could be listening on
+var ErrUnsafeSocket = errors.New("control socket is not safe to use")
+
+// download states
+const (
+	StateResolving   = "resolving" // looking for providers and fetching the manifest
+	StateDownloading = "downloading"
+	StatePaused      = "paused"
+	StateCompleted   = "completed"
+	StateFailed      = "failed"
+	StateCanceled    = "canceled"
+)
+
+// API is what a client can ask a node to do, implemented by Node in process and by Client over the socket
+type API interface {
+	Status(ctx context.Context) (Status, error)
+	Seed(ctx context.Context, req SeedRequest) (FileInfo, error)
+	Unseed(ctx context.Context, fileID string) error
+	StartDownload(ctx context.Context, req DownloadRequest) (DownloadInfo, error)
+	Download(ctx context.Context, id string) (DownloadInfo, error)
+	PauseDownload(ctx context.Context, id string) error
+	ResumeDownload(ctx context.Context, id string) error
+	CancelDownload(ctx context.Context, id string) error
+}
+
+// SeedRequest adds a file or directory to the node's seeder. paths must be absolute, the daemon runs elsewhere
+type SeedRequest struct {
+	Path     string `json:"path"`                // file or directory, or a file id already in the store
+	CDC      bool   `json:"cdc,omitempty"`       // content defined chunking
+	Store    bool   `json:"store,omitempty"`     // import into the chunk store and serve from it
+	StoreDir string `json:"store_dir,omitempty"` // default store location when empty
+}
+
+// FileInfo describes a file the node serves
+type FileInfo struct {
+	FileID   string `json:"file_id"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	Chunks   int    `json:"chunks"`
+	Files    int    `json:"files"`
+	Dir      bool   `json:"dir,omitempty"`
+	Complete bool   `json:"complete"`
+	Link     string `json:"link"`
+}
+
+// DownloadRequest starts a download. paths must be absolute
+type DownloadRequest struct {
+	Target   string        `json:"target"` // file id or bt:// link
+	Output   string        `json:"output"`
+	Pipeline int           `json:"pipeline,omitempty"`
+	Share    bool          `json:"share"`          // serve verified chunks while downloading
+	Seed     bool          `json:"seed,omitempty"` // keep seeding once complete
+	MinPeers int           `json:"min_peers,omitempty"`
+	PeerWait time.Duration `json:"peer_wait,omitempty"`
+	Reuse    string        `json:"reuse,omitempty"` // older local copy to take unchanged chunks from
+	Store    bool          `json:"store,omitempty"` // put verified chunks into the chunk store, the file is recorded once complete
+	StoreDir string        `json:"store_dir,omitempty"`
+}
+
+// DownloadInfo is the progress of one download
+type DownloadInfo struct {
+	ID           string    `json:"id"`
+	Target       string    `json:"target"`
+	FileID       string    `json:"file_id"`
+	Name         string    `json:"name,omitempty"`
+	Output       string    `json:"output"`
+	State        string    `json:"state"`
+	Size         int64     `json:"size"`
+	Chunks       int       `json:"chunks"`
+	ChunksDone   int       `json:"chunks_done"`
+	BytesFetched int64     `json:"bytes_fetched"` // verified bytes from peers in the current run
+	Peers        int       `json:"peers"`
+	FailedChunks []int     `json:"failed_chunks,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	Started      time.Time `json:"started"`
+	Finished     time.Time `json:"finished,omitempty"`
+}
+
+// Done reports whether the download stopped for good
+func (d DownloadInfo) Done() bool {
+	return d.State == StateCompleted || d.State == StateFailed || d.State == StateCanceled
+}
+
+// Status is everything the node is doing
+type Status struct {
+	PeerID     string         `json:"peer_id"`
+	Addrs      []string       `json:"addrs"`
+	LocalPeers int            `json:"local_peers"` // found with mdns
+	Network    Network        `json:"network"`
+	Seeds      []FileInfo     `json:"seeds"`
+	Downloads  []DownloadInfo `json:"downloads"`
+}
+
+// Network is what a node was started with that decides which network it is in and who it serves.
+// seed and download only hand their work to a daemon started with the same settings they were given
+type Network struct {
+	Bootstrap []string `json:"bootstrap"`            // peer ids of the bootstrap peers, sorted
+	DHTPrefix string   `json:"dht_prefix,omitempty"` // empty for the public DHT
+	Listen    []string `json:"listen,omitempty"`     // sorted, empty for random ports
+	SwarmKey  string   `json:"swarm_key,omitempty"`  // fingerprint of the private network key
+	ACL       string   `json:"acl,omitempty"`        // absolute path of the acl file
+	MDNS      bool     `json:"mdns"`
+}
+
+// NewNetwork describes the host options a node is started with
+func NewNetwork(opts p2p.HostOptions, mdns bool) Network {
+	n := Network{Bootstrap: []string{}, MDNS: mdns}
+	for _, pi := range opts.BootstrapPeers() {
+		n.Bootstrap = append(n.Bootstrap, pi.ID.String())
+	}
+	slices.Sort(n.Bootstrap)
+	if opts.PrivateDHT() {
+		n.DHTPrefix = string(opts.DHTPrefix)
+	}
+	n.Listen = slices.Clone(opts.Listen)
+	slices.Sort(n.Listen)
+	if opts.PSK != nil {
+		n.SwarmKey = p2p.SwarmKeyFingerprint(opts.PSK)
+	}
+	if opts.ACL != nil {
+		n.ACL = opts.ACL.Path()
+		if abs, err := filepath.Abs(n.ACL); err == nil {
+			n.ACL = abs
+		}
+	}
+	return n
+}
+
+// Diff names the settings that are not the same in o
+func (n Network) Diff(o Network) []string {
+	var diff []string
+	if !slices.Equal(n.Bootstrap, o.Bootstrap) {
+		diff = append(diff, "bootstrap peers")
+	}
+	if n.DHTPrefix != o.DHTPrefix {
+		diff = append(diff, "dht prefix")
+	}
+	if !slices.Equal(n.Listen, o.Listen) {
+		diff = append(diff, "listen addresses")
+	}
+	if n.SwarmKey != o.SwarmKey {
+		diff = append(diff, "swarm key")
+	}
+	if n.ACL != o.ACL {
+		diff = append(diff, "acl")
+	}
+	if n.MDNS != o.MDNS {
+		diff = append(diff, "mdns")
+	}
+	return diff
+}
+
+// DefaultSocketPath is where the daemon listens unless BT_SOCKET says otherwise,
+// in the user runtime directory when there is one. Otherwise the socket gets a 0700 directory of its own in
+// the temp directory, a socket straight in /tmp could be created by anyone before the daemon starts
+func DefaultSocketPath() string {
+	if p := os.Getenv("BT_SOCKET"); p != "" {
+		return p
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "bt.sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("bt-%d", os.Getuid()), "bt.sock")
+}
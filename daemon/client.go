@@ -0,0 +1,150 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Client talks to a running daemon over its unix socket
+type Client struct {
+	http *http.Client
+}
+
+// Dial connects to the daemon on socketPath, fails quickly when none is running.
+// Requests carry paths and file ids, so a socket or daemon of another user is refused with ErrUnsafeSocket
+func Dial(ctx context.Context, socketPath string) (*Client, error) {
+	if err := checkSocket(socketPath); err != nil {
+		return nil, fmt.Errorf("no daemon on %s: %w", socketPath, err)
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, "unix", socketPath)
+			if err != nil {
+				return nil, err
+			}
+			if err := checkPeer(conn); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		},
+	}
+	c := &Client{http: &http.Client{Transport: transport}}
+
+	pingCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	if _, err := c.Status(pingCtx); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("no daemon on %s: %w", socketPath, err)
+	}
+	return c, nil
+}
+
+// Close drops idle connections to the daemon
+func (c *Client) Close() {
+	c.http.CloseIdleConnections()
+}
+
+func (c *Client) Status(ctx context.Context) (Status, error) {
+	var st Status
+	err := c.call(ctx, http.MethodGet, "/status", nil, &st)
+	return st, err
+}
+
+func (c *Client) Seed(ctx context.Context, req SeedRequest) (FileInfo, error) {
+	var info FileInfo
+	err := c.call(ctx, http.MethodPost, "/seeds", req, &info)
+	return info, err
+}
+
+func (c *Client) Unseed(ctx context.Context, fileID string) error {
+	return c.call(ctx, http.MethodDelete, "/seeds/"+url.PathEscape(fileID), nil, nil)
+}
+
+func (c *Client) StartDownload(ctx context.Context, req DownloadRequest) (DownloadInfo, error) {
+	var info DownloadInfo
+	err := c.call(ctx, http.MethodPost, "/downloads", req, &info)
+	return info, err
+}
+
+func (c *Client) Download(ctx context.Context, id string) (DownloadInfo, error) {
+	var info DownloadInfo
+	err := c.call(ctx, http.MethodGet, "/downloads/"+url.PathEscape(id), nil, &info)
+	return info, err
+}
+
+func (c *Client) PauseDownload(ctx context.Context, id string) error {
+	return c.call(ctx, http.MethodPost, "/downloads/"+url.PathEscape(id)+"/pause", nil, nil)
+}
+
+func (c *Client) ResumeDownload(ctx context.Context, id string) error {
+	return c.call(ctx, http.MethodPost, "/downloads/"+url.PathEscape(id)+"/resume", nil, nil)
+}
+
+func (c *Client) CancelDownload(ctx context.Context, id string) error {
+	return c.call(ctx, http.MethodDelete, "/downloads/"+url.PathEscape(id), nil, nil)
+}
+
+// call sends one request, in is encoded as the body and the reply decoded into out when they are not nil
+func (c *Client) call(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+		body = bytes.NewReader(data)
+	}
+
+	// the host part is ignored, every connection goes to the socket
+	req, err := http.NewRequestWithContext(ctx, method, "http://bt"+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach daemon: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var e errorReply
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error == "" {
+			e.Error = resp.Status
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			return notFoundError(e.Error)
+		}
+		return errors.New(e.Error)
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("failed to decode daemon reply: %w", err)
+		}
+	}
+	return nil
+}
+
+// error from the daemon for an unknown id, matches ErrNotFound
+type notFoundError string
+
+func (e notFoundError) Error() string {
+	return string(e)
+}
+
+func (e notFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
@@ -0,0 +1,279 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/fatih/color"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/srivatsa-bot/bt-p2p/files"
+	"github.com/srivatsa-bot/bt-p2p/p2p"
+)
+
+// how long a download keeps looking on the local network once the DHT found no provider
+const localProviderWait = 15 * time.Second
+
+// a peer on the local network that answered with the manifest
+type localProvider struct {
+	peer     peer.AddrInfo
+	manifest *files.Manifest
+}
+
+// runDownload is one run of a download: find providers, fetch the manifest, fetch every missing chunk and verify
+func (n *Node) runDownload(ctx context.Context, d *download) error {
+	req := d.req
+
+	// A share link carries the file id plus name, size, hash and seeders to dial first
+	fileID := req.Target
+	var link *p2p.ShareLink
+	if p2p.IsShareLink(fileID) {
+		var err error
+		if link, err = p2p.ParseShareLink(fileID); err != nil {
+			return err
+		}
+		fileID = link.FileID
+	} else {
+		id, err := files.ParseFileID(fileID)
+		if err != nil {
+			return err
+		}
+		fileID = id.String()
+	}
+	d.mu.Lock()
+	d.fileID = fileID
+	d.mu.Unlock()
+
+	log.Printf("\n\n%s: %s", color.GreenString("[Searching for file]"), fileID)
+
+	// DHT lookup runs in the background so seeders from the link can be tried while it is still going
+	dhtPeers := make(chan []peer.AddrInfo, 1)
+	go func() {
+		found, err := p2p.FindProviders(ctx, n.kad, fileID)
+		if err != nil {
+			log.Printf("DHT lookup: %v", err)
+		}
+		dhtPeers <- found
+	}()
+
+	// Peers on the local network are asked for the file directly, that works without any DHT
+	localFound := make(chan localProvider)
+	if n.local != nil {
+		p2p.WatchLocalProviders(ctx, n.host, n.local, fileID, func(pi peer.AddrInfo, m *files.Manifest) {
+			select {
+			case localFound <- localProvider{pi, m}:
+			case <-ctx.Done():
+			}
+		})
+	}
+
+	// Fetch the signed manifest before asking for any chunk
+	var peers []peer.AddrInfo
+	var manifest *files.Manifest
+	var err error
+	dhtUsed := false
+	if link != nil && len(link.Peers) > 0 {
+		log.Printf(color.BlueString("Dialing %d peer(s) from share link"), len(link.Peers))
+		manifest, err = p2p.FetchManifest(ctx, n.host, link.Peers, fileID)
+		if err != nil {
+			log.Printf("Peers from share link did not answer, waiting for DHT: %v", err)
+		} else {
+			peers = link.Peers
+		}
+	}
+	if manifest == nil {
+		if manifest, peers, dhtUsed, err = n.waitManifest(ctx, fileID, dhtPeers, localFound); err != nil {
+			return err
+		}
+	}
+	if link != nil {
+		if err := link.Check(manifest); err != nil {
+			return fmt.Errorf("manifest does not match share link: %w", err)
+		}
+	}
+
+	log.Printf("%s %s (%d bytes, %d file(s))", color.GreenString("[File]:"), manifest.Name, manifest.Size, len(manifest.Files))
+
+	// Create output file or directory tree, existing data is kept so an interrupted download can resume
+	content, err := files.CreateContent(req.Output, manifest)
+	if err != nil {
+		return fmt.Errorf("failed to create output: %w", err)
+	}
+
+	log.Printf(color.BlueString("Starting parallel download of %d chunks..."), manifest.ChunkCount())
+	startTime := time.Now()
+
+	// Create parallel chunk downloader
+	downloader := p2p.NewChunkDownloader(n.host, peers, content, manifest)
+	if req.Pipeline > 0 {
+		downloader.SetPipelineDepth(req.Pipeline)
+	}
+	if req.MinPeers > 0 {
+		downloader.SetMinPeers(req.MinPeers)
+	}
+	downloader.SetPeerWait(req.PeerWait)
+
+	d.mu.Lock()
+	d.manifest = manifest
+	d.cd = downloader
+	d.state = StateDownloading
+	d.mu.Unlock()
+
+	// Started before the DHT lookup was done, whatever it finds joins the download later
+	if !dhtUsed {
+		go func() {
+			select {
+			case found := <-dhtPeers:
+				for _, pi := range found {
+					downloader.AddPeer(pi)
+				}
+			case <-ctx.Done():
+			}
+		}()
+	}
+	// and so does every local peer that turns out to have the file
+	go func() {
+		for {
+			select {
+			case lp := <-localFound:
+				downloader.AddPeer(lp.peer)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// Keep looking for providers in the background, new ones join the running download
+	watchCtx, stopWatching := context.WithCancel(ctx)
+	defer stopWatching()
+	go p2p.WatchProviders(watchCtx, n.kad, fileID, downloader)
+
+	// Serve chunks we already verified, the file is announced as soon as we hold one.
+	// the content stays ours until the seeder takes it over to keep seeding
+	var shared *p2p.SharedFile
+	if req.Share || req.Seed {
+		shared, err = n.seeder.AddPartial(n.ctx, req.Output, manifest, content, downloader.Downloaded())
+		if err != nil {
+			log.Printf("Failed to share download: %v", err)
+		}
+	}
+	// Verified chunks go into the chunk store as they come in, so an interrupted download leaves them there too.
+	// they are only kept past a gc once the completed file is recorded
+	var store *files.Store
+	if req.Store {
+		if store, err = openStore(req.StoreDir); err != nil {
+			log.Printf("Not storing download: %v", err)
+		}
+	}
+	downloader.OnChunkVerified(func(chunkID int) {
+		if shared != nil {
+			n.seeder.MarkHave(n.ctx, shared, chunkID)
+		}
+		if store != nil {
+			if err := putChunk(store, manifest, content, chunkID); err != nil {
+				log.Printf("Failed to store chunk %d: %v", chunkID, err)
+			}
+		}
+	})
+	keepSeeding := false
+	defer func() {
+		if shared != nil {
+			n.seeder.EndPartial(shared, keepSeeding)
+		}
+		if !keepSeeding {
+			content.Close()
+		}
+	}()
+
+	// Copy unchanged chunks from an older version first, only the rest goes over the network
+	if req.Reuse != "" {
+		if _, err := downloader.ReuseFrom(ctx, req.Reuse); err != nil {
+			log.Printf("Failed to reuse chunks from %s: %v", req.Reuse, err)
+		}
+	}
+
+	// Start parallel download
+	if err := downloader.DownloadChunksParallel(ctx); err != nil {
+		// Show which chunks failed
+		if failedChunks := downloader.GetFailedChunks(); len(failedChunks) > 0 {
+			log.Printf("Failed chunks: %v", failedChunks)
+			log.Printf("You may need to retry or find more peers")
+		}
+		return fmt.Errorf("download completed with errors: %w", err)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err := downloader.VerifyFile(); err != nil {
+		return fmt.Errorf("downloaded file failed verification: %w", err)
+	}
+	if err := downloader.ClearResumeState(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+
+	// The whole tree is known after verification, so the file can be recorded and its chunks referenced.
+	// chunks stored while downloading are not copied again
+	if store != nil {
+		if err := store.Import(manifest, content); err != nil {
+			log.Printf("Failed to import download into store: %v", err)
+		} else {
+			log.Printf("%s %s", color.GreenString("Imported into store:"), store.Dir())
+		}
+	}
+
+	duration := time.Since(startTime)
+	log.Printf("%s %v!", color.BlueString("[Download completed successfully in:]"), duration)
+
+	// Calculate download speed from bytes actually fetched in this run
+	totalMB := float64(downloader.BytesDownloaded()) / (1024 * 1024)
+	log.Printf("%s %.2f MB/s", color.BlueString("[Average speed:]"), totalMB/duration.Seconds())
+
+	keepSeeding = req.Seed && shared != nil
+	return nil
+}
+
+// putChunk copies a verified chunk of the download into the store
+func putChunk(store *files.Store, m *files.Manifest, content files.Source, chunkID int) error {
+	off, length := m.ChunkRange(chunkID)
+	buf := make([]byte, length)
+	if _, err := content.ReadAt(buf, off); err != nil {
+		return fmt.Errorf("failed to read chunk %d: %w", chunkID, err)
+	}
+	_, err := store.Put(buf)
+	return err
+}
+
+// waitManifest takes the first providers to turn up, from the DHT lookup or the local network, and returns the
+// manifest with them. dhtUsed is true when the DHT result was taken
+func (n *Node) waitManifest(ctx context.Context, fileID string, dhtPeers <-chan []peer.AddrInfo, localFound <-chan localProvider) (m *files.Manifest, peers []peer.AddrInfo, dhtUsed bool, err error) {
+	var giveUp <-chan time.Time // set once the DHT came back empty
+	for {
+		select {
+		case lp := <-localFound:
+			return lp.manifest, []peer.AddrInfo{lp.peer}, dhtPeers == nil, nil
+
+		case found := <-dhtPeers:
+			if len(found) > 0 {
+				log.Printf(color.BlueString("Found %d provider(s)"), len(found))
+				m, err := p2p.FetchManifest(ctx, n.host, found, fileID)
+				if err != nil {
+					return nil, nil, true, fmt.Errorf("failed to fetch manifest: %w", err)
+				}
+				return m, found, true, nil
+			}
+			if n.local == nil {
+				return nil, nil, true, fmt.Errorf("failed to find providers for file %s", fileID)
+			}
+			log.Printf("No providers on the DHT, still looking on the local network")
+			dhtPeers = nil // the lookup is over, a nil channel never fires
+			giveUp = time.After(localProviderWait)
+
+		case <-giveUp:
+			return nil, nil, true, fmt.Errorf("failed to find providers for file %s", fileID)
+
+		case <-ctx.Done():
+			return nil, nil, false, ctx.Err()
+		}
+	}
+}
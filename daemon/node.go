@@ -0,0 +1,353 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/srivatsa-bot/bt-p2p/files"
+	"github.com/srivatsa-bot/bt-p2p/p2p"
+)
+
+// Node is one host and DHT with a seeder and any number of downloads. bt daemon keeps one alive
+// across commands, without a daemon every command runs its own
+type Node struct {
+	ctx     context.Context
+	host    host.Host
+	kad     *dht.IpfsDHT
+	seeder  *p2p.Seeder
+	local   *p2p.LocalPeers // nil without mdns
+	network Network
+
+	seedMutex sync.Mutex // seeder chunking and store settings are per Add, so adds run one at a time
+	mu        sync.Mutex // Protect downloads
+	downloads map[string]*download
+	nextID    int
+}
+
+// one download and how far it got. a paused download keeps its resume state and runs again from there
+type download struct {
+	id  string
+	req DownloadRequest
+
+	mu       sync.Mutex
+	state    string
+	err      error
+	fileID   string
+	manifest *files.Manifest
+	cd       *p2p.ChunkDownloader
+	cancel   context.CancelFunc
+	stopAs   string // state to end in when the run was stopped on purpose
+	done     chan struct{}
+	started  time.Time
+	finished time.Time
+}
+
+// Creates the node and its seeder, everything the node runs stops with ctx
+func NewNode(ctx context.Context, h host.Host, kad *dht.IpfsDHT, reprovideInterval time.Duration) (*Node, error) {
+	seeder, err := p2p.NewSeeder(ctx, h, kad, reprovideInterval)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start seeder: %w", err)
+	}
+	return &Node{
+		ctx:       ctx,
+		host:      h,
+		kad:       kad,
+		seeder:    seeder,
+		downloads: make(map[string]*download),
+	}, nil
+}
+
+// SetLocalPeers lets downloads ask peers found on the local network for their file, call it before the node is used
+func (n *Node) SetLocalPeers(lp *p2p.LocalPeers) {
+	n.local = lp
+}
+
+// SetNetwork records the settings the node's host was created with, Status reports them
+func (n *Node) SetNetwork(network Network) {
+	n.network = network
+}
+
+// SetACL makes the node refuse manifests and chunks to peers the acl does not let pull files
+func (n *Node) SetACL(acl *p2p.ACL) {
+	n.seeder.SetACL(acl)
+}
+
+// Status lists what the node serves and every download it knows
+func (n *Node) Status(ctx context.Context) (Status, error) {
+	st := Status{PeerID: n.host.ID().String(), Network: n.network, Seeds: []FileInfo{}, Downloads: []DownloadInfo{}}
+	for _, a := range n.host.Addrs() {
+		st.Addrs = append(st.Addrs, a.String()+"/p2p/"+n.host.ID().String())
+	}
+	for _, f := range n.seeder.Files() {
+		st.Seeds = append(st.Seeds, n.fileInfo(f))
+	}
+	if n.local != nil {
+		st.LocalPeers = len(n.local.Peers())
+	}
+
+	n.mu.Lock()
+	downloads := make([]*download, 0, len(n.downloads))
+	for _, d := range n.downloads {
+		downloads = append(downloads, d)
+	}
+	n.mu.Unlock()
+	for _, d := range downloads {
+		st.Downloads = append(st.Downloads, d.info())
+	}
+	sort.Slice(st.Downloads, func(i, j int) bool { return st.Downloads[i].Started.Before(st.Downloads[j].Started) })
+	return st, nil
+}
+
+// Seed starts serving a file or directory, or a file already in the chunk store
+func (n *Node) Seed(ctx context.Context, req SeedRequest) (FileInfo, error) {
+	if !filepath.IsAbs(req.Path) {
+		if _, err := files.ParseFileID(req.Path); err != nil || !req.Store {
+			return FileInfo{}, fmt.Errorf("seed path must be absolute: %s", req.Path)
+		}
+	}
+
+	n.seedMutex.Lock()
+	defer n.seedMutex.Unlock()
+
+	var store *files.Store
+	if req.Store {
+		var err error
+		if store, err = openStore(req.StoreDir); err != nil {
+			return FileInfo{}, err
+		}
+	}
+	var chunking *files.CDCParams
+	if req.CDC {
+		params := files.DefaultCDCParams
+		chunking = &params
+	}
+	n.seeder.SetChunking(chunking)
+	n.seeder.SetStore(store)
+
+	var f *p2p.SharedFile
+	var err error
+	if !filepath.IsAbs(req.Path) {
+		f, err = n.seeder.AddFromStore(n.ctx, req.Path)
+	} else {
+		f, err = n.seeder.Add(n.ctx, req.Path)
+	}
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return n.fileInfo(f), nil
+}
+
+// Unseed stops serving a file. A file still being downloaded is refused, cancelling the download stops serving it
+func (n *Node) Unseed(ctx context.Context, fileID string) error {
+	err := n.seeder.Remove(fileID)
+	if errors.Is(err, p2p.ErrDownloading) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("file %s: %w", fileID, ErrNotFound)
+	}
+	return nil
+}
+
+func (n *Node) fileInfo(f *p2p.SharedFile) FileInfo {
+	return FileInfo{
+		FileID:   f.ID,
+		Name:     f.Manifest.Name,
+		Path:     f.Path,
+		Size:     f.Manifest.Size,
+		Chunks:   f.Manifest.ChunkCount(),
+		Files:    len(f.Manifest.Files),
+		Dir:      f.Manifest.Dir,
+		Complete: f.Complete(),
+		Link:     p2p.NewShareLink(n.host, f.Manifest).String(),
+	}
+}
+
+// StartDownload starts a download in the background, follow it with Download
+func (n *Node) StartDownload(ctx context.Context, req DownloadRequest) (DownloadInfo, error) {
+	if req.Target == "" {
+		return DownloadInfo{}, fmt.Errorf("no file id or share link to download")
+	}
+	if !filepath.IsAbs(req.Output) {
+		return DownloadInfo{}, fmt.Errorf("output path must be absolute: %q", req.Output)
+	}
+	if req.Reuse != "" && !filepath.IsAbs(req.Reuse) {
+		return DownloadInfo{}, fmt.Errorf("reuse path must be absolute: %s", req.Reuse)
+	}
+
+	// the run is set up before the download can be looked up, a pause right away finds its cancel
+	n.mu.Lock()
+	n.nextID++
+	d := &download{id: strconv.Itoa(n.nextID), req: req, started: time.Now()}
+	d.mu.Lock()
+	n.run(d)
+	d.mu.Unlock()
+	n.downloads[d.id] = d
+	n.mu.Unlock()
+
+	return d.info(), nil
+}
+
+// Download returns the progress of a download
+func (n *Node) Download(ctx context.Context, id string) (DownloadInfo, error) {
+	d, err := n.get(id)
+	if err != nil {
+		return DownloadInfo{}, err
+	}
+	return d.info(), nil
+}
+
+// PauseDownload stops a running download, chunks already verified are kept for ResumeDownload
+func (n *Node) PauseDownload(ctx context.Context, id string) error {
+	d, err := n.get(id)
+	if err != nil {
+		return err
+	}
+	return d.stop(StatePaused)
+}
+
+// ResumeDownload runs a paused or failed download again from where it stopped
+func (n *Node) ResumeDownload(ctx context.Context, id string) error {
+	d, err := n.get(id)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.state != StatePaused && d.state != StateFailed {
+		return fmt.Errorf("download %s is %s", id, d.state)
+	}
+	n.run(d)
+	return nil
+}
+
+// CancelDownload stops a download for good, data on disk is left as it is
+func (n *Node) CancelDownload(ctx context.Context, id string) error {
+	d, err := n.get(id)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	paused := d.state == StatePaused || d.state == StateFailed
+	if paused {
+		d.state = StateCanceled
+	}
+	d.mu.Unlock()
+	if paused {
+		return nil
+	}
+	return d.stop(StateCanceled)
+}
+
+func (n *Node) get(id string) (*download, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	d, ok := n.downloads[id]
+	if !ok {
+		return nil, fmt.Errorf("download %s: %w", id, ErrNotFound)
+	}
+	return d, nil
+}
+
+// run starts one run of a download in the background, called with d.mu held. The state, cancel and done of
+// the new run are set in the same critical section that claims the download, so a pause or cancel right
+// after stops this run and not the one before it
+func (n *Node) run(d *download) {
+	ctx, cancel := context.WithCancel(n.ctx)
+	d.state = StateResolving
+	d.err = nil
+	d.stopAs = ""
+	d.cancel = cancel
+	d.done = make(chan struct{})
+	d.finished = time.Time{}
+	done := d.done
+
+	go func() {
+		defer close(done)
+		defer cancel()
+		err := n.runDownload(ctx, d)
+
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.finished = time.Now()
+		switch {
+		case d.stopAs != "":
+			d.state = d.stopAs
+		case ctx.Err() != nil:
+			d.state = StateCanceled // the node is shutting down
+		case err != nil:
+			d.state = StateFailed
+			d.err = err
+		default:
+			d.state = StateCompleted
+		}
+	}()
+}
+
+// stop ends the current run and waits for it, the download ends up in state
+func (d *download) stop(state string) error {
+	d.mu.Lock()
+	if d.state != StateResolving && d.state != StateDownloading {
+		d.mu.Unlock()
+		return fmt.Errorf("download %s is %s", d.id, d.state)
+	}
+	d.stopAs = state
+	d.cancel()
+	done := d.done
+	d.mu.Unlock()
+
+	<-done
+	return nil
+}
+
+func (d *download) info() DownloadInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	info := DownloadInfo{
+		ID:       d.id,
+		Target:   d.req.Target,
+		FileID:   d.fileID,
+		Output:   d.req.Output,
+		State:    d.state,
+		Started:  d.started,
+		Finished: d.finished,
+	}
+	if d.err != nil {
+		info.Error = d.err.Error()
+	}
+	if d.manifest != nil {
+		info.Name = d.manifest.Name
+		info.Size = d.manifest.Size
+		info.Chunks = d.manifest.ChunkCount()
+	}
+	if d.cd != nil {
+		info.ChunksDone = d.cd.Downloaded().Count()
+		info.BytesFetched = d.cd.BytesDownloaded()
+		info.Peers = d.cd.ActivePeers()
+		info.FailedChunks = d.cd.GetFailedChunks()
+	}
+	return info
+}
+
+// opens the chunk store, dir "" means the default location
+func openStore(dir string) (*files.Store, error) {
+	if dir == "" {
+		var err error
+		if dir, err = files.DefaultStoreDir(); err != nil {
+			return nil, err
+		}
+	}
+	store, err := files.OpenStore(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store: %w", err)
+	}
+	return store, nil
+}
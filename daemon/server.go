@@ -0,0 +1,136 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// Serve runs the control api for the node on a unix socket until ctx is cancelled.
+// Only the user running the daemon can use the socket
+func Serve(ctx context.Context, node *Node, socketPath string) error {
+	// the socket must not be somewhere another user could put their own in its place
+	if err := checkSocketDir(filepath.Dir(socketPath), true); err != nil {
+		return err
+	}
+
+	// a socket left behind by a daemon that died is removed, a live one means a daemon is already running
+	if _, err := os.Stat(socketPath); err == nil {
+		if c, err := Dial(ctx, socketPath); err == nil {
+			c.Close()
+			return fmt.Errorf("a daemon is already listening on %s", socketPath)
+		}
+		if err := os.Remove(socketPath); err != nil {
+			return fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	}
+
+	l, err := listenSocket(socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", socketPath, err)
+	}
+	defer os.Remove(socketPath)
+
+	srv := &http.Server{Handler: newHandler(node), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("%s %s", color.GreenString("Control API listening on:"), socketPath)
+	if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("control api stopped: %w", err)
+	}
+	return nil
+}
+
+// routes of the control api, all bodies are json
+func newHandler(api API) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		st, err := api.Status(r.Context())
+		reply(w, st, err)
+	})
+
+	mux.HandleFunc("POST /seeds", func(w http.ResponseWriter, r *http.Request) {
+		var req SeedRequest
+		if !decode(w, r, &req) {
+			return
+		}
+		info, err := api.Seed(r.Context(), req)
+		reply(w, info, err)
+	})
+	mux.HandleFunc("DELETE /seeds/{id}", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, nil, api.Unseed(r.Context(), r.PathValue("id")))
+	})
+
+	mux.HandleFunc("POST /downloads", func(w http.ResponseWriter, r *http.Request) {
+		var req DownloadRequest
+		if !decode(w, r, &req) {
+			return
+		}
+		info, err := api.StartDownload(r.Context(), req)
+		reply(w, info, err)
+	})
+	mux.HandleFunc("GET /downloads/{id}", func(w http.ResponseWriter, r *http.Request) {
+		info, err := api.Download(r.Context(), r.PathValue("id"))
+		reply(w, info, err)
+	})
+	mux.HandleFunc("POST /downloads/{id}/pause", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, nil, api.PauseDownload(r.Context(), r.PathValue("id")))
+	})
+	mux.HandleFunc("POST /downloads/{id}/resume", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, nil, api.ResumeDownload(r.Context(), r.PathValue("id")))
+	})
+	mux.HandleFunc("DELETE /downloads/{id}", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, nil, api.CancelDownload(r.Context(), r.PathValue("id")))
+	})
+
+	return mux
+}
+
+// error body sent with every non 2xx status
+type errorReply struct {
+	Error string `json:"error"`
+}
+
+func decode(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(v); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorReply{Error: fmt.Sprintf("invalid request: %v", err)})
+		return false
+	}
+	return true
+}
+
+// writes v, or the error with a status that tells a missing id apart from a failed request
+func reply(w http.ResponseWriter, v any, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		writeJSON(w, http.StatusNotFound, errorReply{Error: err.Error()})
+	case err != nil:
+		writeJSON(w, http.StatusBadRequest, errorReply{Error: err.Error()})
+	case v == nil:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSON(w, http.StatusOK, v)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write control api reply: %v", err)
+	}
+}
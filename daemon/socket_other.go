@@ -0,0 +1,24 @@
+//go:build !unix
+
+package daemon
+
+import (
+	"net"
+	"os"
+)
+
+// No umask or file owners outside unix, the socket only gets a directory of its own
+func listenSocket(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
+
+func checkSocket(path string) error {
+	return nil
+}
+
+func checkSocketDir(dir string, create bool) error {
+	if create {
+		return os.MkdirAll(dir, 0700)
+	}
+	return nil
+}
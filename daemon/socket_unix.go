@@ -0,0 +1,64 @@
+//go:build unix
+
+package daemon
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// listenSocket listens on a unix socket only this user can connect to. The socket is created under a umask
+// that leaves it 0600, a chmod after listening would leave it open to everyone for a moment.
+// The umask is process wide, the daemon calls this once while starting
+func listenSocket(path string) (net.Listener, error) {
+	old := syscall.Umask(0o177)
+	l, err := net.Listen("unix", path)
+	syscall.Umask(old)
+	return l, err
+}
+
+// checkSocket makes sure the socket at path belongs to this user and sits where no other user can swap it,
+// before anything is sent to whoever listens on it
+func checkSocket(path string) error {
+	if err := checkSocketDir(filepath.Dir(path), false); err != nil {
+		return err
+	}
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s is not a socket", path)
+	}
+	if uid := fi.Sys().(*syscall.Stat_t).Uid; int(uid) != os.Getuid() {
+		return fmt.Errorf("socket %s belongs to user %d: %w", path, uid, ErrUnsafeSocket)
+	}
+	return nil
+}
+
+// checkSocketDir fails for a directory other users could create or replace the socket in, like /tmp.
+// it has to belong to this user or root and not be writable by anyone else. create makes it 0700 when missing
+func checkSocketDir(dir string, create bool) error {
+	if create {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("failed to create socket directory: %w", err)
+		}
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return fmt.Errorf("failed to check socket directory: %w", err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("socket directory %s is not a directory", dir)
+	}
+	if uid := int(fi.Sys().(*syscall.Stat_t).Uid); uid != os.Getuid() && uid != 0 {
+		return fmt.Errorf("socket directory %s belongs to user %d: %w", dir, uid, ErrUnsafeSocket)
+	}
+	if fi.Mode().Perm()&0o022 != 0 {
+		return fmt.Errorf("socket directory %s is writable by other users, set BT_SOCKET or XDG_RUNTIME_DIR: %w", dir, ErrUnsafeSocket)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package files
+
+// Bitfield tracks which chunks are present, bit i set means chunk i is there
+type Bitfield []byte
+
+func NewBitfield(n int) Bitfield {
+	return make(Bitfield, (n+7)/8)
+}
+
+func (b Bitfield) Has(i int) bool {
+	if i < 0 || i/8 >= len(b) {
+		return false
+	}
+	return b[i/8]&(0x80>>(i%8)) != 0
+}
+
+func (b Bitfield) Set(i int) {
+	if i < 0 || i/8 >= len(b) {
+		return
+	}
+	b[i/8] |= 0x80 >> (i % 8)
+}
+
+// Number of set bits
+func (b Bitfield) Count() int {
+	n := 0
+	for _, v := range b {
+		for ; v != 0; v &= v - 1 {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,121 @@
+package files
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// content defined chunking (FastCDC). cut points depend on the bytes around them instead of a fixed
+// stride, so inserting or removing data only changes the chunks next to the edit
+
+// CDCParams bounds the chunk sizes, they are part of the manifest so anyone can cut the same way
+type CDCParams struct {
+	Min int `json:"min"`
+	Avg int `json:"avg"`
+	Max int `json:"max"`
+}
+
+// Default sizes for content defined chunking, averaging the same as fixed chunks
+var DefaultCDCParams = CDCParams{Min: 128 * 1024, Avg: 512 * 1024, Max: 2 * 1024 * 1024}
+
+// chunks can not be bigger than this, a chunk has to fit in one wire response
+const maxCDCChunk = 8 * 1024 * 1024
+
+func (p CDCParams) Validate() error {
+	if p.Min <= 0 || p.Min > p.Avg || p.Avg > p.Max {
+		return fmt.Errorf("invalid chunk sizes min %d avg %d max %d", p.Min, p.Avg, p.Max)
+	}
+	if p.Max > maxCDCChunk {
+		return fmt.Errorf("max chunk size %d is over %d", p.Max, maxCDCChunk)
+	}
+	return nil
+}
+
+// gear table, fixed so every client cuts the same content at the same places
+var gear = func() [256]uint64 {
+	var t [256]uint64
+	x := uint64(0x62742d636463) // splitmix64
+	for i := range t {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		t[i] = z ^ (z >> 31)
+	}
+	return t
+}()
+
+// masks for normalized chunking: a harder one before the average size and an easier one after it,
+// so chunk sizes bunch up around the average. bits are taken from the top of the hash which mixes the last 64 bytes
+func (p CDCParams) masks() (uint64, uint64) {
+	b := bits.Len(uint(p.Avg)) - 1
+	hard := ^uint64(0) << (64 - (b + 1))
+	easy := ^uint64(0) << (64 - (b - 1))
+	return hard, easy
+}
+
+// cut returns the length of the next chunk at the start of buf. buf holds up to Max bytes,
+// less only at the end of the content
+func (p CDCParams) cut(buf []byte) int {
+	n := len(buf)
+	if n <= p.Min {
+		return n
+	}
+	if n > p.Max {
+		n = p.Max
+	}
+	normal := p.Avg
+	if normal > n {
+		normal = n
+	}
+
+	hard, easy := p.masks()
+	var fp uint64
+	i := p.Min
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[buf[i]]
+		if fp&hard == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[buf[i]]
+		if fp&easy == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// CDCOffsets reads r to the end and returns where every chunk starts
+func CDCOffsets(r io.Reader, p CDCParams) ([]int64, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	var offsets []int64
+	var pos int64
+	buf := make([]byte, p.Max)
+	filled := 0
+	eof := false
+	for {
+		if !eof {
+			n, err := io.ReadFull(r, buf[filled:])
+			filled += n
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return nil, fmt.Errorf("failed to read content for chunking: %w", err)
+			}
+		}
+		if filled == 0 {
+			return offsets, nil
+		}
+
+		n := p.cut(buf[:filled])
+		offsets = append(offsets, pos)
+		pos += int64(n)
+		filled = copy(buf, buf[n:filled])
+	}
+}
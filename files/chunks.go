@@ -70,8 +70,13 @@ func FileHash(filePath string) ([32]byte, error) {
 	}
 	defer file.Close()
 
+	return HashReader(file)
+}
+
+// Returns sha of everything read from r
+func HashReader(r io.Reader) ([32]byte, error) {
 	hash := sha256.New()
-	if _, err := io.Copy(hash, file); err != nil {
+	if _, err := io.Copy(hash, r); err != nil {
 		return [32]byte{}, fmt.Errorf("failed to hash file: %w", err)
 	}
 
@@ -0,0 +1,277 @@
+package files
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// at most this many files of a content are kept open, a directory with more files reopens them as they are used
+const maxOpenFiles = 64
+
+// Content presents the files listed in a manifest as one contiguous byte range,
+// chunks are addressed over that range so a chunk can span the end of one file and the start of the next
+type Content struct {
+	path    string
+	paths   []string // where each file is on disk
+	flag    int      // flags the files are opened with
+	offsets []int64  // start of each file inside the combined range
+	sizes   []int64
+	size    int64
+
+	mu     sync.Mutex
+	open   map[int]*openFile // files with a handle, lru has the most recently used first
+	lru    *list.List
+	dirty  map[int]bool // files written since the last Sync
+	closed bool
+}
+
+// a handle of one file, closed once it is evicted and no read or write is using it
+type openFile struct {
+	f       *os.File
+	elem    *list.Element
+	refs    int
+	evicted bool
+}
+
+// Opens content read only, used on seeder side. root is the seeded file or directory
+func OpenContent(root string, m *Manifest) (*Content, error) {
+	return openContent(root, m, os.O_RDONLY)
+}
+
+// Creates the output file or directory tree for a manifest, used on leecher side.
+// Existing data is kept so an interrupted download can resume, every file is sized exactly
+func CreateContent(root string, m *Manifest) (*Content, error) {
+	if m.Dir {
+		if err := os.MkdirAll(root, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create directory %s: %w", root, err)
+		}
+	}
+
+	c, err := openContent(root, m, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		return nil, err
+	}
+
+	// Pre-allocate file space for better performance, each file ends up at exactly the real size
+	for i := range c.paths {
+		if err := c.withFile(i, false, func(f *os.File) error { return Preallocate(f, c.sizes[i]) }); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// every file is opened once up front so a missing one fails here, only the last maxOpenFiles stay open
+func openContent(root string, m *Manifest, flag int) (*Content, error) {
+	paths, err := m.LocalPaths(root)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Content{
+		path:  root,
+		paths: paths,
+		flag:  flag,
+		open:  make(map[int]*openFile),
+		lru:   list.New(),
+		dirty: make(map[int]bool),
+	}
+	for i, p := range paths {
+		if flag&os.O_CREATE != 0 {
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				c.Close()
+				return nil, fmt.Errorf("failed to create directory for %s: %w", p, err)
+			}
+		}
+
+		if err := c.withFile(i, false, func(*os.File) error { return nil }); err != nil {
+			c.Close()
+			return nil, err
+		}
+
+		c.offsets = append(c.offsets, c.size)
+		c.sizes = append(c.sizes, m.Files[i].Size)
+		c.size += m.Files[i].Size
+	}
+	return c, nil
+}
+
+// Path of the seeded or downloaded file or directory
+func (c *Content) Path() string {
+	return c.path
+}
+
+// Total size of all files
+func (c *Content) Size() int64 {
+	return c.size
+}
+
+// ReadAt reads from the combined range, crossing file boundaries as needed
+func (c *Content) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+
+	n := 0
+	for n < len(p) {
+		i, fileOff, ok := c.locate(off + int64(n))
+		if !ok {
+			return n, io.EOF
+		}
+		want := min64(int64(len(p)-n), c.sizes[i]-fileOff)
+		var m int
+		err := c.withFile(i, false, func(f *os.File) (err error) {
+			m, err = f.ReadAt(p[n:n+int(want)], fileOff)
+			return err
+		})
+		n += m
+		if err != nil && !(err == io.EOF && int64(m) == want) {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// WriteAt writes into the combined range, crossing file boundaries as needed
+func (c *Content) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > c.size {
+		return 0, fmt.Errorf("write of %d bytes at %d is outside content of size %d", len(p), off, c.size)
+	}
+
+	n := 0
+	for n < len(p) {
+		i, fileOff, _ := c.locate(off + int64(n))
+		want := min64(int64(len(p)-n), c.sizes[i]-fileOff)
+		var m int
+		err := c.withFile(i, true, func(f *os.File) (err error) {
+			m, err = f.WriteAt(p[n:n+int(want)], fileOff)
+			return err
+		})
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Sync flushes every file written since the last Sync to disk. a file whose handle was closed
+// in the meantime is opened again, fsync covers all writes to a file whichever handle made them
+func (c *Content) Sync() error {
+	c.mu.Lock()
+	dirty := make([]int, 0, len(c.dirty))
+	for i := range c.dirty {
+		dirty = append(dirty, i)
+	}
+	clear(c.dirty)
+	c.mu.Unlock()
+
+	for k, i := range dirty {
+		if err := c.withFile(i, false, func(f *os.File) error { return f.Sync() }); err != nil {
+			// whatever was not synced still is dirty
+			c.mu.Lock()
+			for _, j := range dirty[k:] {
+				c.dirty[j] = true
+			}
+			c.mu.Unlock()
+			return fmt.Errorf("failed to sync %s: %w", c.paths[i], err)
+		}
+	}
+	return nil
+}
+
+func (c *Content) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	var firstErr error
+	for i := range c.open {
+		if err := c.evict(i); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// withFile runs fn with an open handle of file i, opening it and closing the least recently used one when needed
+func (c *Content) withFile(i int, write bool, fn func(f *os.File) error) error {
+	of, err := c.acquire(i, write)
+	if err != nil {
+		return err
+	}
+	defer c.release(of)
+	return fn(of.f)
+}
+
+func (c *Content) acquire(i int, write bool) (*openFile, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, fmt.Errorf("failed to open %s: %w", c.paths[i], os.ErrClosed)
+	}
+	if write {
+		c.dirty[i] = true
+	}
+
+	if of, ok := c.open[i]; ok {
+		of.refs++
+		c.lru.MoveToFront(of.elem)
+		return of, nil
+	}
+	f, err := os.OpenFile(c.paths[i], c.flag, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", c.paths[i], err)
+	}
+	of := &openFile{f: f, refs: 1}
+	of.elem = c.lru.PushFront(i)
+	c.open[i] = of
+	for c.lru.Len() > maxOpenFiles {
+		c.evict(c.lru.Back().Value.(int))
+	}
+	return of, nil
+}
+
+func (c *Content) release(of *openFile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	of.refs--
+	if of.evicted && of.refs == 0 {
+		of.f.Close()
+	}
+}
+
+// drops file i from the open set, the handle is closed now or by the last release. called with c.mu held
+func (c *Content) evict(i int) error {
+	of := c.open[i]
+	delete(c.open, i)
+	c.lru.Remove(of.elem)
+	of.evicted = true
+	if of.refs == 0 {
+		return of.f.Close()
+	}
+	return nil
+}
+
+// finds which file holds the byte at off and where inside that file it is
+func (c *Content) locate(off int64) (int, int64, bool) {
+	if off >= c.size {
+		return 0, 0, false
+	}
+	// first file that starts after off, the one before it holds the byte.
+	// empty files share their start with the next file so they never get picked
+	i := sort.Search(len(c.offsets), func(i int) bool { return c.offsets[i] > off }) - 1
+	return i, off - c.offsets[i], true
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
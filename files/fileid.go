@@ -0,0 +1,57 @@
+package files
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// File ids are CIDv1 with the raw codec and a sha2-256 multihash of the merkle root together with what
+// shapes the tree: the content size and the chunking. Anyone holding the data can recompute the id, and the
+// same content chunked the same way gets the same id in every client, whatever it is called. The name and
+// the file list are not part of it, the manifest signature and the share link check cover those
+
+// what a file id is the hash of
+type treeKey struct {
+	Root      string     `json:"root"`
+	Size      int64      `json:"size"`
+	ChunkSize int        `json:"chunk_size"`
+	CDC       *CDCParams `json:"cdc,omitempty"`
+	Offsets   []int64    `json:"offsets,omitempty"` // where each content defined chunk starts
+}
+
+// Builds the file id for a merkle root and the chunking that gave it. offsets is nil for fixed size chunks
+func FileIDFromTree(root [32]byte, size int64, chunkSize int, cdc *CDCParams, offsets []int64) (cid.Cid, error) {
+	data, err := json.Marshal(treeKey{Root: hex.EncodeToString(root[:]), Size: size, ChunkSize: chunkSize, CDC: cdc, Offsets: offsets})
+	if err != nil {
+		return cid.Undef, fmt.Errorf("failed to encode tree: %w", err)
+	}
+	mhash, err := mh.Sum(data, mh.SHA2_256, -1)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("failed to create multihash: %w", err)
+	}
+	return cid.NewCidV1(cid.Raw, mhash), nil
+}
+
+// Parses a file id given by a user or peer. Any multibase is accepted, String() on the result
+// gives the canonical base32 form that is used on the wire and in the DHT
+func ParseFileID(s string) (cid.Cid, error) {
+	c, err := cid.Decode(s)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("invalid file id %q: %w", s, err)
+	}
+	if c.Version() != 1 || c.Type() != cid.Raw {
+		return cid.Undef, fmt.Errorf("invalid file id %q: expected a CIDv1 with raw codec", s)
+	}
+	decoded, err := mh.Decode(c.Hash())
+	if err != nil {
+		return cid.Undef, fmt.Errorf("invalid file id %q: %w", s, err)
+	}
+	if decoded.Code != mh.SHA2_256 || decoded.Length != 32 {
+		return cid.Undef, fmt.Errorf("invalid file id %q: expected a sha2-256 hash", s)
+	}
+	return c, nil
+}
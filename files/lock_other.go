@@ -0,0 +1,13 @@
+//go:build !unix
+
+package files
+
+// No flock outside unix, only the in process mutex guards the store
+func (s *Store) lock(exclusive bool) (release func(), err error) {
+	return func() {}, nil
+}
+
+// and files served from the store are not protected from Remove
+func (s *Store) hold(fileID string, remove bool) (release func(), err error) {
+	return func() {}, nil
+}
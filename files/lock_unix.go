@@ -0,0 +1,55 @@
+//go:build unix
+
+package files
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lock takes a flock on the store's lock file, waiting while another process holds it the other way.
+// Imports and removes share it, GC needs it alone since it deletes chunks another process may be about to record.
+// The lock is dropped by the kernel when the process dies
+func (s *Store) lock(exclusive bool) (release func(), err error) {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	release, err = flock(s.lockPath(), how)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock store: %w", err)
+	}
+	return release, nil
+}
+
+// hold marks a stored file as served for as long as its source is open, in this process or any other.
+// Remove takes the same lock alone and without waiting, so it fails for a held file instead of leaving
+// its chunks to the next GC
+func (s *Store) hold(fileID string, remove bool) (release func(), err error) {
+	how := syscall.LOCK_SH
+	if remove {
+		how = syscall.LOCK_EX | syscall.LOCK_NB
+	}
+	release, err = flock(s.holdPath(fileID), how)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return nil, fmt.Errorf("file %s: %w", fileID, ErrFileServed)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock file %s: %w", fileID, err)
+	}
+	return release, nil
+}
+
+func flock(path string, how int) (release func(), err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
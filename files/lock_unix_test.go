@@ -0,0 +1,82 @@
+//go:build unix
+
+package files
+
+import (
+	"crypto/rand"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStoreGCWaitsForImports(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "store")
+	a, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a holds the shared lock like an import in progress, the lock is per open file so this works within one process
+	release, err := a.lock(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		b.GC()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("gc ran during an import")
+	case <-time.After(200 * time.Millisecond):
+	}
+	release()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("gc did not run once the import was done")
+	}
+}
+
+func TestStoreRemoveWhileServed(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "store")
+	s, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 2*ChunkSize+3)
+	rand.Read(data)
+	m := importTestFile(t, s, "a.bin", data)
+
+	// a seeder in another process opened the file, the lock is per open file so a second store stands in for it
+	other, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, src, err := other.Open(m.FileID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove(m.FileID()); !errors.Is(err, ErrFileServed) {
+		t.Fatalf("removed a file being served: %v", err)
+	}
+	if removed, _, err := s.GC(); err != nil || removed != 0 {
+		t.Fatalf("gc removed %d chunks of a served file (%v)", removed, err)
+	}
+
+	src.Close()
+	src.Close() // closing twice must not release someone else's hold
+	if err := s.Remove(m.FileID()); err != nil {
+		t.Fatal(err)
+	}
+	if removed, _, err := s.GC(); err != nil || removed != 3 {
+		t.Fatalf("gc removed %d chunks, want 3 (%v)", removed, err)
+	}
+}
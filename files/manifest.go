@@ -0,0 +1,425 @@
+package files
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// returned when chunk or file data does not match the hash in the manifest
+var ErrHashMismatch = errors.New("hash mismatch")
+
+// limits on what a manifest may ask for, checked before anything is sized from it.
+// a chunk has to fit in one wire response, and at the limits the merkle tree of a leecher takes about 140MB
+const (
+	MaxChunkSize = 16 * 1024 * 1024
+	MaxChunks    = 1 << 21 // 1TB with the default chunk size
+)
+
+// Manifest describes a seeded file or directory, leecher fetches it before asking for any chunk
+type Manifest struct {
+	Name      string      `json:"name"`
+	Size      int64       `json:"size"` // total size of all files
+	ChunkSize int         `json:"chunk_size"`
+	FileHash  string      `json:"file_hash"`     // hex sha256 of all files back to back
+	Root      string      `json:"root"`          // hex merkle root over the chunk hashes
+	Dir       bool        `json:"dir,omitempty"` // set when a whole directory is seeded
+	Files     []FileEntry `json:"files"`
+
+	// set for content defined chunking, chunk i starts at Offsets[i] and ChunkSize is the largest a chunk can be
+	CDC     *CDCParams `json:"cdc,omitempty"`
+	Offsets []int64    `json:"offsets,omitempty"`
+
+	// chunk hashes are not sent, the seeder proves each chunk against Root as it sends it
+	tree     *MerkleTree
+	treeOnce sync.Once
+
+	id     string
+	idOnce sync.Once
+}
+
+// FileEntry is one file inside the seeded content, chunks run across files in this order
+type FileEntry struct {
+	Path string `json:"path"` // slash separated, relative to the seeded directory
+	Size int64  `json:"size"`
+}
+
+// Builds the manifest for a file or directory on seeder side
+func BuildManifest(path string) (*Manifest, error) {
+	return buildManifest(path, ChunkSize, nil)
+}
+
+// Builds the manifest with content defined chunks, so a new version of the content shares most
+// chunks with the old one and leechers holding the old one only fetch what changed
+func BuildManifestCDC(path string, p CDCParams) (*Manifest, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return buildManifest(path, p.Max, &p)
+}
+
+// Builds the manifest of local content chunked the same way as m, used to find chunks an old copy has in common with m
+func BuildManifestLike(path string, m *Manifest) (*Manifest, error) {
+	if m.CDC != nil {
+		return BuildManifestCDC(path, *m.CDC)
+	}
+	return buildManifest(path, m.ChunkSize, nil)
+}
+
+func buildManifest(path string, chunkSize int, cdc *CDCParams) (*Manifest, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get info about file %s: %w", path, err)
+	}
+
+	m := &Manifest{
+		Name:      filepath.Base(path),
+		ChunkSize: chunkSize,
+		Dir:       info.IsDir(),
+		CDC:       cdc,
+	}
+
+	if m.Dir {
+		if m.Files, err = listFiles(path); err != nil {
+			return nil, err
+		}
+	} else {
+		m.Files = []FileEntry{{Path: m.Name, Size: info.Size()}}
+	}
+	for _, f := range m.Files {
+		m.Size += f.Size
+	}
+	if err := m.validateChunkCount(); err != nil {
+		return nil, err
+	}
+
+	content, err := OpenContent(path, m)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	if m.CDC != nil {
+		if m.Offsets, err = CDCOffsets(io.NewSectionReader(content, 0, m.Size), *m.CDC); err != nil {
+			return nil, err
+		}
+		if err := m.validateChunkCount(); err != nil {
+			return nil, err
+		}
+	}
+
+	// hash every chunk and the whole content in one pass
+	fileHash, leaves, err := m.hashContent(io.NewSectionReader(content, 0, m.Size))
+	if err != nil {
+		return nil, err
+	}
+	m.tree = NewMerkleTree(leaves)
+	root := m.tree.Root()
+	m.FileHash = hex.EncodeToString(fileHash[:])
+	m.Root = hex.EncodeToString(root[:])
+
+	return m, nil
+}
+
+// reads the content front to back, returns the sha256 of all of it and the hash of every chunk
+func (m *Manifest) hashContent(r io.Reader) ([32]byte, [][32]byte, error) {
+	var sum [32]byte
+	fileHash := sha256.New()
+	leaves := make([][32]byte, 0, m.expectedChunks())
+	buf := make([]byte, m.ChunkSize)
+	for i := 0; i < m.expectedChunks(); i++ {
+		_, length := m.ChunkRange(i)
+		if _, err := io.ReadFull(r, buf[:length]); err != nil {
+			return sum, nil, fmt.Errorf("failed to read chunk %d: %w", i, err)
+		}
+		leaves = append(leaves, ChunkHash(buf[:length]))
+		fileHash.Write(buf[:length])
+	}
+	copy(sum[:], fileHash.Sum(nil))
+	return sum, leaves, nil
+}
+
+// Walks a directory and lists every regular file in it, sorted so every seeder gets the same order
+func listFiles(root string) ([]FileEntry, error) {
+	var entries []FileEntry
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil // skip directories, symlinks and devices
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, FileEntry{Path: filepath.ToSlash(rel), Size: info.Size()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list directory %s: %w", root, err)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("directory %s has no files", root)
+	}
+	return entries, nil
+}
+
+// Maps every file entry to a path under root. For a single file root is the file itself.
+// Paths from a remote manifest are checked so they cant escape root
+func (m *Manifest) LocalPaths(root string) ([]string, error) {
+	if !m.Dir {
+		if len(m.Files) != 1 {
+			return nil, fmt.Errorf("single file manifest lists %d files", len(m.Files))
+		}
+		return []string{root}, nil
+	}
+
+	paths := make([]string, 0, len(m.Files))
+	seen := make(map[string]bool, len(m.Files))
+	for _, f := range m.Files {
+		if !fs.ValidPath(f.Path) || f.Path == "." {
+			return nil, fmt.Errorf("invalid path in manifest: %q", f.Path)
+		}
+		if seen[f.Path] {
+			return nil, fmt.Errorf("duplicate path in manifest: %q", f.Path)
+		}
+		seen[f.Path] = true
+		paths = append(paths, filepath.Join(root, filepath.FromSlash(f.Path)))
+	}
+	return paths, nil
+}
+
+// Offset and length of a chunk inside the combined content
+func (m *Manifest) ChunkRange(chunkID int) (int64, int) {
+	if m.CDC != nil {
+		if chunkID < 0 || chunkID >= len(m.Offsets) {
+			return m.Size, 0
+		}
+		end := m.Size
+		if chunkID+1 < len(m.Offsets) {
+			end = m.Offsets[chunkID+1]
+		}
+		return m.Offsets[chunkID], int(end - m.Offsets[chunkID])
+	}
+
+	off := int64(chunkID) * int64(m.ChunkSize)
+	length := min64(int64(m.ChunkSize), m.Size-off)
+	if length < 0 {
+		length = 0
+	}
+	return off, int(length)
+}
+
+// index of the chunk holding the byte at off
+func (m *Manifest) chunkAt(off int64) int {
+	if m.CDC != nil {
+		return sort.Search(len(m.Offsets), func(i int) bool { return m.Offsets[i] > off }) - 1
+	}
+	return int(off / int64(m.ChunkSize))
+}
+
+func (m *Manifest) expectedChunks() int {
+	if m.CDC != nil {
+		return len(m.Offsets)
+	}
+	n := int(m.Size / int64(m.ChunkSize))
+	if m.Size%int64(m.ChunkSize) != 0 {
+		n++
+	}
+	return n
+}
+
+// File id used on the network, a CID of the merkle root and the chunking. Worked out once, a manifest
+// is not changed after it is built or received. empty if the root is not a valid hash
+func (m *Manifest) FileID() string {
+	m.idOnce.Do(func() {
+		root, err := decodeHash(m.Root)
+		if err != nil {
+			return
+		}
+		c, err := FileIDFromTree(root, m.Size, m.ChunkSize, m.CDC, m.Offsets)
+		if err != nil {
+			return
+		}
+		m.id = c.String()
+	})
+	return m.id
+}
+
+// Number of chunks the file is split into
+func (m *Manifest) ChunkCount() int {
+	return m.expectedChunks()
+}
+
+// Tree is the merkle tree over the chunk hashes. The seeder has all of it,
+// a leecher starts from the root and learns the rest from the proofs it checks
+func (m *Manifest) Tree() *MerkleTree {
+	m.treeOnce.Do(func() {
+		if m.tree == nil {
+			root, _ := decodeHash(m.Root)
+			m.tree = NewPartialMerkleTree(m.expectedChunks(), root)
+		}
+	})
+	return m.tree
+}
+
+// Checks that the manifest is self consistent and within limits, used on leecher side before trusting it.
+// nothing may be allocated from a remote manifest before this passes
+func (m *Manifest) Validate() error {
+	if m.ChunkSize <= 0 {
+		return fmt.Errorf("invalid chunk size %d", m.ChunkSize)
+	}
+	if m.CDC == nil && m.ChunkSize > MaxChunkSize {
+		return fmt.Errorf("chunk size %d is over %d", m.ChunkSize, MaxChunkSize)
+	}
+	if m.CDC != nil {
+		if err := m.CDC.Validate(); err != nil {
+			return err
+		}
+		if m.ChunkSize != m.CDC.Max {
+			return fmt.Errorf("chunk size %d does not match max chunk size %d", m.ChunkSize, m.CDC.Max)
+		}
+	}
+	if m.Size < 0 {
+		return fmt.Errorf("invalid file size %d", m.Size)
+	}
+	if err := m.validateChunkCount(); err != nil {
+		return err
+	}
+
+	if len(m.Files) == 0 {
+		return fmt.Errorf("manifest lists no files")
+	}
+	var total int64
+	for _, f := range m.Files {
+		if f.Size < 0 {
+			return fmt.Errorf("invalid size %d for %s", f.Size, f.Path)
+		}
+		total += f.Size
+	}
+	if total != m.Size {
+		return fmt.Errorf("file sizes add up to %d, manifest says %d", total, m.Size)
+	}
+	if _, err := m.LocalPaths("."); err != nil {
+		return err
+	}
+
+	if err := m.validateOffsets(); err != nil {
+		return err
+	}
+
+	if _, err := decodeHash(m.FileHash); err != nil {
+		return fmt.Errorf("invalid file hash: %w", err)
+	}
+	if _, err := decodeHash(m.Root); err != nil {
+		return fmt.Errorf("invalid merkle root: %w", err)
+	}
+	return nil
+}
+
+// chunk count is worked out without converting the size first, a huge size must not overflow into a small count
+func (m *Manifest) validateChunkCount() error {
+	count := int64(len(m.Offsets))
+	if m.CDC == nil {
+		count = m.Size / int64(m.ChunkSize)
+		if m.Size%int64(m.ChunkSize) != 0 {
+			count++
+		}
+	}
+	if count > MaxChunks {
+		return fmt.Errorf("content of %d bytes has %d chunks, at most %d are supported", m.Size, count, MaxChunks)
+	}
+	return nil
+}
+
+// chunk offsets of a content defined manifest must cover the content in order, no chunk bigger than ChunkSize.
+// CDC params and the chunk count are already checked
+func (m *Manifest) validateOffsets() error {
+	if m.CDC == nil {
+		if len(m.Offsets) > 0 {
+			return fmt.Errorf("chunk offsets without content defined chunking")
+		}
+		return nil
+	}
+	if m.Size == 0 {
+		if len(m.Offsets) > 0 {
+			return fmt.Errorf("empty content with %d chunk offsets", len(m.Offsets))
+		}
+		return nil
+	}
+	if len(m.Offsets) == 0 || m.Offsets[0] != 0 {
+		return fmt.Errorf("chunk offsets must start at 0")
+	}
+	for i := range m.Offsets {
+		_, length := m.ChunkRange(i)
+		if length <= 0 || length > m.ChunkSize {
+			return fmt.Errorf("chunk %d has invalid size %d", i, length)
+		}
+	}
+	return nil
+}
+
+// Checks chunk data against the merkle root. proof can be nil when the chunk hash is already known
+func (m *Manifest) VerifyChunk(chunkID int, data []byte, proof MerkleProof) error {
+	if _, length := m.ChunkRange(chunkID); chunkID < 0 || len(data) != length {
+		return fmt.Errorf("chunk %d: got %d bytes: %w", chunkID, len(data), ErrHashMismatch)
+	}
+	return m.Tree().Verify(chunkID, ChunkHash(data), proof)
+}
+
+// Checks the full content against the file hash and the merkle root in the manifest.
+// On success the whole tree is known, so proofs can be served for every chunk
+func (m *Manifest) VerifyFile(r io.Reader) error {
+	want, err := decodeHash(m.FileHash)
+	if err != nil {
+		return fmt.Errorf("invalid file hash: %w", err)
+	}
+	got, leaves, err := m.hashContent(r)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("file: %w", ErrHashMismatch)
+	}
+	return m.Tree().Fill(leaves)
+}
+
+// Encodes the manifest, this exact byte form is what gets signed
+func (m *Manifest) Marshal() ([]byte, error) {
+	return json.Marshal(m)
+}
+
+func UnmarshalManifest(data []byte) (*Manifest, error) {
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	return &m, nil
+}
+
+// hex string -> 32 byte sha256
+func decodeHash(s string) ([32]byte, error) {
+	var out [32]byte
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return out, err
+	}
+	if len(b) != len(out) {
+		return out, fmt.Errorf("expected %d bytes, got %d", len(out), len(b))
+	}
+	copy(out[:], b)
+	return out, nil
+}
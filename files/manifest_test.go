@@ -0,0 +1,118 @@
+package files
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testManifest(t *testing.T) *Manifest {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(path, make([]byte, 3*ChunkSize+5), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := BuildManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// decoded copy of m, changed by edit before anything is worked out from it
+func editManifest(t *testing.T, m *Manifest, edit func(*Manifest)) *Manifest {
+	t.Helper()
+	data, err := m.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := UnmarshalManifest(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edit(c)
+	return c
+}
+
+func TestManifestValidate(t *testing.T) {
+	m := testManifest(t)
+	if err := m.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		edit func(*Manifest)
+	}{
+		{"zero chunk size", func(m *Manifest) { m.ChunkSize = 0 }},
+		{"chunk size over the limit", func(m *Manifest) { m.ChunkSize = MaxChunkSize + 1 }},
+		{"too many chunks", func(m *Manifest) {
+			m.ChunkSize = 1
+			m.Size = MaxChunks + 1
+			m.Files[0].Size = m.Size
+		}},
+		{"size overflowing the chunk count", func(m *Manifest) {
+			m.Size = 1<<63 - 1
+			m.Files[0].Size = m.Size
+		}},
+		{"negative size", func(m *Manifest) { m.Size = -1 }},
+		{"file sizes do not add up", func(m *Manifest) { m.Files[0].Size++ }},
+		{"no files", func(m *Manifest) { m.Files = nil }},
+		{"path escaping the output", func(m *Manifest) {
+			m.Dir = true
+			m.Files[0].Path = "../x"
+		}},
+		{"cdc max over the limit", func(m *Manifest) {
+			m.CDC = &CDCParams{Min: 1, Avg: 2, Max: 1 << 30}
+			m.ChunkSize = m.CDC.Max
+		}},
+		{"cdc max and chunk size differ", func(m *Manifest) {
+			p := DefaultCDCParams
+			m.CDC = &p
+		}},
+		{"bad root", func(m *Manifest) { m.Root = "zz" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := editManifest(t, m, tt.edit).Validate(); err == nil {
+				t.Fatal("manifest was accepted")
+			}
+		})
+	}
+}
+
+func TestManifestFileID(t *testing.T) {
+	m := testManifest(t)
+	id := m.FileID()
+	if _, err := ParseFileID(id); err != nil {
+		t.Fatal(err)
+	}
+	if got := editManifest(t, m, func(*Manifest) {}).FileID(); got != id {
+		t.Fatalf("decoded manifest has id %s, want %s", got, id)
+	}
+
+	// the id covers the tree and its shape, not what the content is called
+	tests := []struct {
+		name string
+		edit func(*Manifest)
+		same bool
+	}{
+		{"name", func(m *Manifest) { m.Name = "other.bin" }, true},
+		{"file path", func(m *Manifest) { m.Files[0].Path = "other.bin" }, true},
+		{"file hash", func(m *Manifest) { m.FileHash = m.Root }, true},
+		{"root", func(m *Manifest) { m.Root = m.FileHash }, false},
+		{"size", func(m *Manifest) { m.Size-- }, false},
+		{"chunk size", func(m *Manifest) { m.ChunkSize = 2 * ChunkSize }, false},
+		{"cdc", func(m *Manifest) {
+			m.CDC = &CDCParams{Min: 1, Avg: 2, Max: m.ChunkSize}
+			m.Offsets = []int64{0}
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := editManifest(t, m, tt.edit).FileID(); (got == id) != tt.same {
+				t.Errorf("file id %s after the edit, was %s", got, id)
+			}
+		})
+	}
+}
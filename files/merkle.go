@@ -0,0 +1,284 @@
+package files
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/bits"
+	"sync"
+)
+
+// returned when a chunk can not be checked because nothing proves its hash yet
+var ErrNoProof = errors.New("no proof for chunk")
+
+// MerkleTree is a binary hash tree over the chunk hashes, like BitTorrent v2 (BEP 52).
+// Leaves are padded with zero hashes up to a power of two and a parent is sha256(left || right).
+// The seeder holds every node, a leecher starts with only the root and fills in the nodes of every proof it checks,
+// so it can hand the same proofs on when it re-serves chunks
+type MerkleTree struct {
+	mu     sync.RWMutex
+	leaves int
+	width  int        // leaves rounded up to a power of two
+	nodes  [][32]byte // nodes[1] is the root, children of i are 2i and 2i+1, leaves start at width
+	known  []bool
+}
+
+// MerkleProof is the sibling hashes from a leaf up to just below the root
+type MerkleProof [][32]byte
+
+// Builds the full tree from the chunk hashes
+func NewMerkleTree(leafHashes [][32]byte) *MerkleTree {
+	t := newTree(len(leafHashes))
+	for i := range t.known {
+		t.known[i] = true
+	}
+	copy(t.nodes[t.width:], leafHashes)
+	for i := t.width - 1; i >= 1; i-- {
+		t.nodes[i] = hashPair(t.nodes[2*i], t.nodes[2*i+1])
+	}
+	return t
+}
+
+// Starts a tree that only knows its root, used on leecher side
+func NewPartialMerkleTree(leaves int, root [32]byte) *MerkleTree {
+	t := newTree(leaves)
+	t.nodes[1] = root
+	t.known[1] = true
+
+	// padding leaves are zero by definition, no proof needed for them
+	for i := leaves; i < t.width; i++ {
+		t.nodes[t.width+i] = [32]byte{}
+		t.known[t.width+i] = true
+	}
+	return t
+}
+
+func newTree(leaves int) *MerkleTree {
+	width := 1
+	if leaves > 1 {
+		width = 1 << bits.Len(uint(leaves-1))
+	}
+	return &MerkleTree{
+		leaves: leaves,
+		width:  width,
+		nodes:  make([][32]byte, 2*width),
+		known:  make([]bool, 2*width),
+	}
+}
+
+// Root of the tree, zero for a file without chunks
+func (t *MerkleTree) Root() [32]byte {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.nodes[1]
+}
+
+// Leaves is the number of chunks the tree covers
+func (t *MerkleTree) Leaves() int {
+	return t.leaves
+}
+
+// Leaf returns the hash of a chunk if the tree knows it
+func (t *MerkleTree) Leaf(i int) ([32]byte, bool) {
+	if i < 0 || i >= t.leaves {
+		return [32]byte{}, false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.nodes[t.width+i], t.known[t.width+i]
+}
+
+// Proof returns the sibling hashes for a chunk, false if some of them are not known yet
+func (t *MerkleTree) Proof(i int) (MerkleProof, bool) {
+	if i < 0 || i >= t.leaves {
+		return nil, false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var proof MerkleProof
+	for n := t.width + i; n > 1; n /= 2 {
+		sib := n ^ 1
+		if !t.known[sib] {
+			return nil, false
+		}
+		proof = append(proof, t.nodes[sib])
+	}
+	return proof, true
+}
+
+// PathIndexes gives where the leaf of a chunk and the nodes of its proof sit in the tree's numbering,
+// the root is 1 and the children of node n are 2n and 2n+1. A partial tree is saved by writing the leaf and proof
+// of every checked chunk at these places, and built up again by handing them back to Verify
+func (t *MerkleTree) PathIndexes(i int) (leaf int, proof []int) {
+	leaf = t.width + i
+	for n := leaf; n > 1; n /= 2 {
+		proof = append(proof, n^1)
+	}
+	return leaf, proof
+}
+
+// Verify checks a chunk hash against the root. A leaf the tree already knows needs no proof,
+// otherwise the proof is checked and its nodes are remembered
+func (t *MerkleTree) Verify(i int, leaf [32]byte, proof MerkleProof) error {
+	if i < 0 || i >= t.leaves {
+		return fmt.Errorf("chunk %d out of range", i)
+	}
+
+	if known, ok := t.Leaf(i); ok {
+		if known != leaf {
+			return fmt.Errorf("chunk %d: %w", i, ErrHashMismatch)
+		}
+		return nil
+	}
+	if proof == nil {
+		return fmt.Errorf("chunk %d: %w", i, ErrNoProof)
+	}
+	if len(proof) != bits.Len(uint(t.width))-1 {
+		return fmt.Errorf("chunk %d: proof has %d hashes, expected %d", i, len(proof), bits.Len(uint(t.width))-1)
+	}
+
+	// walk up to the root, every node on the way is checked by the root at the end
+	path := make([][32]byte, len(proof)+1)
+	path[0] = leaf
+	n := t.width + i
+	for level, sib := range proof {
+		if n%2 == 0 {
+			path[level+1] = hashPair(path[level], sib)
+		} else {
+			path[level+1] = hashPair(sib, path[level])
+		}
+		n /= 2
+	}
+	if path[len(proof)] != t.Root() {
+		return fmt.Errorf("chunk %d: %w", i, ErrHashMismatch)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n = t.width + i
+	for level, sib := range proof {
+		t.nodes[n], t.known[n] = path[level], true
+		t.nodes[n^1], t.known[n^1] = sib, true
+		n /= 2
+	}
+	return nil
+}
+
+// RangeProof returns the hashes of count chunks from first on and the proof of the subtree they make up,
+// like the hash requests of BEP 52. count is a power of two and first a multiple of it, a count wider than the
+// tree is cut down to the tree. Padding past the last chunk is not returned. false if some hash is not known yet
+func (t *MerkleTree) RangeProof(first, count int) ([][32]byte, MerkleProof, bool) {
+	count, err := t.span(first, count)
+	if err != nil {
+		return nil, nil, false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	end := min(first+count, t.leaves)
+	leaves := make([][32]byte, 0, end-first)
+	for i := first; i < end; i++ {
+		if !t.known[t.width+i] {
+			return nil, nil, false
+		}
+		leaves = append(leaves, t.nodes[t.width+i])
+	}
+	var proof MerkleProof
+	for n := (t.width + first) / count; n > 1; n /= 2 {
+		if !t.known[n^1] {
+			return nil, nil, false
+		}
+		proof = append(proof, t.nodes[n^1])
+	}
+	return leaves, proof, true
+}
+
+// VerifyRange checks the chunk hashes of a RangeProof against the root and remembers every node of the range,
+// so each of its chunks has a proof afterwards
+func (t *MerkleTree) VerifyRange(first, count int, leaves [][32]byte, proof MerkleProof) error {
+	count, err := t.span(first, count)
+	if err != nil {
+		return err
+	}
+	if want := min(first+count, t.leaves) - first; len(leaves) != want {
+		return fmt.Errorf("chunks %d+%d: got %d hashes, expected %d", first, count, len(leaves), want)
+	}
+	top := (t.width + first) / count
+	if len(proof) != bits.Len(uint(top))-1 {
+		return fmt.Errorf("chunks %d+%d: proof has %d hashes, expected %d", first, count, len(proof), bits.Len(uint(top))-1)
+	}
+
+	// the subtree numbered like the tree itself, sub[1] is its root and padding leaves stay zero
+	sub := make([][32]byte, 2*count)
+	copy(sub[count:], leaves)
+	for n := count - 1; n >= 1; n-- {
+		sub[n] = hashPair(sub[2*n], sub[2*n+1])
+	}
+	path := make([][32]byte, len(proof)+1)
+	path[0] = sub[1]
+	n := top
+	for level, sib := range proof {
+		if n%2 == 0 {
+			path[level+1] = hashPair(path[level], sib)
+		} else {
+			path[level+1] = hashPair(sib, path[level])
+		}
+		n /= 2
+	}
+	if path[len(proof)] != t.Root() {
+		return fmt.Errorf("chunks %d+%d: %w", first, count, ErrHashMismatch)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// node k of the subtree at depth d is node top<<d + k-1<<d of the tree
+	for k := 1; k < 2*count; k++ {
+		d := bits.Len(uint(k)) - 1
+		at := top<<d + k - 1<<d
+		t.nodes[at], t.known[at] = sub[k], true
+	}
+	n = top
+	for level, sib := range proof {
+		t.nodes[n], t.known[n] = path[level], true
+		t.nodes[n^1], t.known[n^1] = sib, true
+		n /= 2
+	}
+	return nil
+}
+
+// span checks a range of chunks is a whole subtree and cuts count down to the width of the tree
+func (t *MerkleTree) span(first, count int) (int, error) {
+	if count < 1 || count&(count-1) != 0 {
+		return 0, fmt.Errorf("range of %d chunks is not a power of two", count)
+	}
+	count = min(count, t.width)
+	if first < 0 || first >= t.leaves || first%count != 0 {
+		return 0, fmt.Errorf("range %d+%d does not start at a subtree of the tree", first, count)
+	}
+	return count, nil
+}
+
+// Fill replaces a partial tree with the full tree built from every chunk hash, once they are all known.
+// fails without changing anything when the hashes do not add up to the root
+func (t *MerkleTree) Fill(leafHashes [][32]byte) error {
+	full := NewMerkleTree(leafHashes)
+	if full.leaves != t.leaves {
+		return fmt.Errorf("got %d chunk hashes, tree has %d", full.leaves, t.leaves)
+	}
+	if full.Root() != t.Root() {
+		return fmt.Errorf("merkle root: %w", ErrHashMismatch)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nodes, t.known = full.nodes, full.known
+	return nil
+}
+
+func hashPair(left, right [32]byte) [32]byte {
+	var buf [64]byte
+	copy(buf[:32], left[:])
+	copy(buf[32:], right[:])
+	return sha256.Sum256(buf[:])
+}
@@ -0,0 +1,167 @@
+package files
+
+import (
+	"errors"
+	"testing"
+)
+
+func testLeaves(n int) [][32]byte {
+	leaves := make([][32]byte, n)
+	for i := range leaves {
+		leaves[i] = ChunkHash([]byte{byte(i), byte(n)})
+	}
+	return leaves
+}
+
+func TestMerkleVerify(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 5, 8, 13} {
+		leaves := testLeaves(n)
+		full := NewMerkleTree(leaves)
+		part := NewPartialMerkleTree(n, full.Root())
+
+		for i := 0; i < n; i++ {
+			proof, ok := full.Proof(i)
+			if !ok {
+				t.Fatalf("%d leaves: full tree has no proof for %d", n, i)
+			}
+			if err := part.Verify(i, ChunkHash([]byte("other")), proof); !errors.Is(err, ErrHashMismatch) {
+				t.Fatalf("%d leaves: wrong leaf %d gave %v", n, i, err)
+			}
+			if _, ok := part.Leaf(i); !ok {
+				if err := part.Verify(i, leaves[i], nil); !errors.Is(err, ErrNoProof) {
+					t.Fatalf("%d leaves: leaf %d without proof gave %v", n, i, err)
+				}
+			}
+			if err := part.Verify(i, leaves[i], proof); err != nil {
+				t.Fatalf("%d leaves: leaf %d: %v", n, i, err)
+			}
+			// the partial tree can hand the same proof on
+			got, ok := part.Proof(i)
+			if !ok || len(got) != len(proof) {
+				t.Fatalf("%d leaves: partial tree has no proof for %d", n, i)
+			}
+			for level := range proof {
+				if got[level] != proof[level] {
+					t.Fatalf("%d leaves: proof of %d differs at level %d", n, i, level)
+				}
+			}
+		}
+		if n == 1 && full.Root() != leaves[0] {
+			t.Errorf("root of a single leaf is not the leaf")
+		}
+	}
+}
+
+func TestMerkleFill(t *testing.T) {
+	leaves := testLeaves(5)
+	root := NewMerkleTree(leaves).Root()
+
+	if err := NewPartialMerkleTree(5, root).Fill(leaves); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewPartialMerkleTree(5, root).Fill(leaves[:4]); err == nil {
+		t.Error("fill with a missing leaf was accepted")
+	}
+	bad := append([][32]byte{}, leaves...)
+	bad[3][0] ^= 1
+	if err := NewPartialMerkleTree(5, root).Fill(bad); !errors.Is(err, ErrHashMismatch) {
+		t.Errorf("fill with a wrong leaf gave %v", err)
+	}
+}
+
+func TestMerklePathIndexes(t *testing.T) {
+	leaves := testLeaves(6)
+	tree := NewMerkleTree(leaves)
+	for i := range leaves {
+		leafAt, proofAt := tree.PathIndexes(i)
+		proof, _ := tree.Proof(i)
+		if tree.nodes[leafAt] != leaves[i] || len(proofAt) != len(proof) {
+			t.Fatalf("leaf %d: wrong indexes %d %v", i, leafAt, proofAt)
+		}
+		for level, at := range proofAt {
+			if tree.nodes[at] != proof[level] {
+				t.Fatalf("leaf %d: proof index %d at level %d is not the proof node", i, at, level)
+			}
+		}
+	}
+}
+
+func TestMerkleVerifyRange(t *testing.T) {
+	tests := []struct {
+		leaves, first, count int
+	}{
+		{1, 0, 1},
+		{1, 0, 4096},
+		{5, 0, 8},
+		{5, 4, 4},
+		{5, 2, 2},
+		{13, 8, 8},
+		{13, 12, 1},
+		{100, 64, 32},
+	}
+	for _, tt := range tests {
+		leaves := testLeaves(tt.leaves)
+		full := NewMerkleTree(leaves)
+		got, proof, ok := full.RangeProof(tt.first, tt.count)
+		if !ok {
+			t.Fatalf("%+v: no range proof", tt)
+		}
+		end := min(tt.first+tt.count, tt.leaves)
+		if len(got) != end-tt.first {
+			t.Fatalf("%+v: got %d hashes, want %d", tt, len(got), end-tt.first)
+		}
+
+		part := NewPartialMerkleTree(tt.leaves, full.Root())
+		if err := part.VerifyRange(tt.first, tt.count, got, proof); err != nil {
+			t.Fatalf("%+v: %v", tt, err)
+		}
+		// every chunk of the range can be proven now, and the range handed on
+		for i := tt.first; i < end; i++ {
+			if p, ok := part.Proof(i); !ok || full.Verify(i, leaves[i], p) != nil {
+				t.Fatalf("%+v: no valid proof for chunk %d", tt, i)
+			}
+		}
+		if _, _, ok := part.RangeProof(tt.first, tt.count); !ok {
+			t.Fatalf("%+v: partial tree can not send the range on", tt)
+		}
+
+		if len(got) > 0 {
+			got[len(got)-1][0] ^= 1
+			if err := NewPartialMerkleTree(tt.leaves, full.Root()).VerifyRange(tt.first, tt.count, got, proof); !errors.Is(err, ErrHashMismatch) {
+				t.Fatalf("%+v: tampered range gave %v", tt, err)
+			}
+		}
+	}
+}
+
+func TestMerkleVerifyRangeRejects(t *testing.T) {
+	leaves := testLeaves(13)
+	full := NewMerkleTree(leaves)
+	hashes, proof, _ := full.RangeProof(4, 4)
+
+	tests := []struct {
+		name   string
+		first  int
+		count  int
+		hashes [][32]byte
+		proof  MerkleProof
+	}{
+		{"count not a power of two", 4, 3, hashes[:3], proof},
+		{"not aligned", 2, 4, hashes, proof},
+		{"past the end", 16, 4, hashes, proof},
+		{"too few hashes", 4, 4, hashes[:3], proof},
+		{"short proof", 4, 4, hashes, proof[1:]},
+		{"range moved", 8, 4, hashes, proof},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			part := NewPartialMerkleTree(13, full.Root())
+			if err := part.VerifyRange(tt.first, tt.count, tt.hashes, tt.proof); err == nil {
+				t.Fatal("range was accepted")
+			}
+			if _, ok := part.Leaf(tt.first % 13); ok {
+				t.Fatal("rejected range left hashes in the tree")
+			}
+		})
+	}
+}
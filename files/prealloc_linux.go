@@ -0,0 +1,23 @@
+package files
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Reserves disk space for the whole file up front and sets it to exactly size bytes.
+// Uses fallocate so the blocks are really allocated, falls back to truncate if the filesystem cant do it
+func Preallocate(file *os.File, size int64) error {
+	if size > 0 {
+		if err := syscall.Fallocate(int(file.Fd()), 0, 0, size); err != nil && err != syscall.EOPNOTSUPP && err != syscall.ENOSYS {
+			return fmt.Errorf("failed to allocate %d bytes: %w", size, err)
+		}
+	}
+
+	// fallocate never shrinks, truncate drops anything past the real end
+	if err := file.Truncate(size); err != nil {
+		return fmt.Errorf("failed to set file size to %d: %w", size, err)
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package files
+
+import (
+	"fmt"
+	"os"
+)
+
+// Sets the file to exactly size bytes, no fallocate outside linux so this is a sparse truncate
+func Preallocate(file *os.File, size int64) error {
+	if err := file.Truncate(size); err != nil {
+		return fmt.Errorf("failed to set file size to %d: %w", size, err)
+	}
+	return nil
+}
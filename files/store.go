@@ -0,0 +1,516 @@
+package files
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Store is a content addressed chunk store: a directory holding every chunk once, named by its hash.
+// Files are imported as a record of their manifest and chunk hashes, chunks shared between files are kept once
+// and a chunk is only deleted by GC once no record refers to it anymore.
+//
+//	<dir>/chunks/<first 2 hex chars>/<chunk hash in hex>
+//	<dir>/files/<file id>.json
+//	<dir>/files/<file id>.lock
+//	<dir>/lock
+//
+// Several processes can use one store, a daemon importing downloads while bt store gc runs.
+// The lock file keeps GC from running while any of them imports or removes a file,
+// and a file's own lock keeps it from being removed while it is served from the store
+type Store struct {
+	dir  string
+	mu   sync.Mutex
+	refs map[[32]byte]int // how many chunks of stored files are each hash
+}
+
+// returned by Remove for a file some process serves from the store
+var ErrFileServed = errors.New("file is being served from the store")
+
+// what the store keeps about an imported file
+type storeRecord struct {
+	Manifest *Manifest `json:"manifest"`
+	Leaves   []string  `json:"leaves"` // hex chunk hashes in order
+}
+
+// StoredFile is a file held in the store
+type StoredFile struct {
+	ID       string
+	Manifest *Manifest
+}
+
+// Source is anything the content of a manifest can be read from, the files themselves or the chunk store
+type Source interface {
+	io.ReaderAt
+	io.Closer
+	Size() int64
+}
+
+// Default location of the chunk store, under the user cache directory
+func DefaultStoreDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find cache directory: %w", err)
+	}
+	return filepath.Join(dir, "bt", "store"), nil
+}
+
+// Opens the store in dir, creating it if needed. Reference counts are rebuilt from the file records
+func OpenStore(dir string) (*Store, error) {
+	for _, sub := range []string{"chunks", "files"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create store directory: %w", err)
+		}
+	}
+
+	s := &Store{dir: dir}
+	refs, err := s.countRefs()
+	if err != nil {
+		return nil, err
+	}
+	s.refs = refs
+	return s, nil
+}
+
+// counts the references to every chunk from the file records on disk
+func (s *Store) countRefs() (map[[32]byte]int, error) {
+	refs := make(map[[32]byte]int)
+	records, err := s.records()
+	if err != nil {
+		return nil, err
+	}
+	for _, rec := range records {
+		leaves, err := rec.leaves()
+		if err != nil {
+			return nil, err
+		}
+		for _, leaf := range leaves {
+			refs[leaf]++
+		}
+	}
+	return refs, nil
+}
+
+// Dir is where the store lives
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+func (s *Store) chunkPath(hash [32]byte) string {
+	h := hex.EncodeToString(hash[:])
+	return filepath.Join(s.dir, "chunks", h[:2], h)
+}
+
+func (s *Store) lockPath() string {
+	return filepath.Join(s.dir, "lock")
+}
+
+func (s *Store) recordPath(fileID string) string {
+	return filepath.Join(s.dir, "files", fileID+".json")
+}
+
+func (s *Store) holdPath(fileID string) string {
+	return filepath.Join(s.dir, "files", fileID+".lock")
+}
+
+// Has reports whether a chunk is in the store
+func (s *Store) Has(hash [32]byte) bool {
+	_, err := os.Stat(s.chunkPath(hash))
+	return err == nil
+}
+
+// Put writes a chunk under its hash unless it is already there. The chunk is only kept past
+// the next GC once a file referring to it is imported
+func (s *Store) Put(data []byte) ([32]byte, error) {
+	release, err := s.lock(false)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	defer release()
+	return s.put(data)
+}
+
+func (s *Store) put(data []byte) ([32]byte, error) {
+	hash := ChunkHash(data)
+	if s.Has(hash) {
+		return hash, nil
+	}
+
+	path := s.chunkPath(hash)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return hash, fmt.Errorf("failed to create chunk directory: %w", err)
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return hash, fmt.Errorf("failed to store chunk: %w", err)
+	}
+	return hash, nil
+}
+
+// HasFile reports whether a file was imported into the store
+func (s *Store) HasFile(fileID string) bool {
+	_, err := os.Stat(s.recordPath(fileID))
+	return err == nil
+}
+
+// Get reads a chunk by its hash
+func (s *Store) Get(hash [32]byte) ([]byte, error) {
+	data, err := os.ReadFile(s.chunkPath(hash))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk %x: %w", hash, err)
+	}
+	return data, nil
+}
+
+// Import copies every chunk of a file into the store and records the file. m must know every chunk hash,
+// which holds for a manifest built locally or one whose download passed VerifyFile.
+// Chunks already in the store are not read again
+func (s *Store) Import(m *Manifest, src Source) error {
+	// chunks written here are not referenced until the record is, GC must not run in between
+	release, err := s.lock(false)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	tree := m.Tree()
+	leaves := make([][32]byte, m.ChunkCount())
+	for i := range leaves {
+		leaf, ok := tree.Leaf(i)
+		if !ok {
+			return fmt.Errorf("hash of chunk %d is not known: %w", i, ErrNoProof)
+		}
+		leaves[i] = leaf
+	}
+
+	buf := make([]byte, m.ChunkSize)
+	for i, leaf := range leaves {
+		if s.Has(leaf) {
+			continue
+		}
+		off, length := m.ChunkRange(i)
+		if _, err := src.ReadAt(buf[:length], off); err != nil {
+			return fmt.Errorf("failed to read chunk %d: %w", i, err)
+		}
+		if ChunkHash(buf[:length]) != leaf {
+			return fmt.Errorf("chunk %d: %w", i, ErrHashMismatch)
+		}
+		if _, err := s.put(buf[:length]); err != nil {
+			return err
+		}
+	}
+
+	hexLeaves := make([]string, len(leaves))
+	for i, leaf := range leaves {
+		hexLeaves[i] = hex.EncodeToString(leaf[:])
+	}
+	data, err := json.Marshal(storeRecord{Manifest: m, Leaves: hexLeaves})
+	if err != nil {
+		return fmt.Errorf("failed to encode store record: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// importing the same file again must not count its chunks twice
+	_, statErr := os.Stat(s.recordPath(m.FileID()))
+	if err := writeFileAtomic(s.recordPath(m.FileID()), data); err != nil {
+		return err
+	}
+	if os.IsNotExist(statErr) {
+		for _, leaf := range leaves {
+			s.refs[leaf]++
+		}
+	}
+	return nil
+}
+
+// Open returns the manifest of a stored file and a source reading its content from the store.
+// The file can not be removed from the store until the source is closed
+func (s *Store) Open(fileID string) (m *Manifest, src Source, err error) {
+	if err := checkFileID(fileID); err != nil {
+		return nil, nil, err
+	}
+	if !s.HasFile(fileID) {
+		return nil, nil, fmt.Errorf("file %s is not in the store", fileID)
+	}
+	release, err := s.hold(fileID, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if err != nil {
+			release()
+		}
+	}()
+
+	rec, err := s.record(fileID)
+	if err != nil {
+		return nil, nil, err
+	}
+	leaves, err := rec.leaves()
+	if err != nil {
+		return nil, nil, err
+	}
+	m = rec.Manifest
+	if err := m.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("invalid manifest in store: %w", err)
+	}
+	if m.FileID() != fileID {
+		return nil, nil, fmt.Errorf("store record of %s holds the manifest of %s", fileID, m.FileID())
+	}
+	if len(leaves) != m.ChunkCount() {
+		return nil, nil, fmt.Errorf("store has %d chunk hashes for %d chunks", len(leaves), m.ChunkCount())
+	}
+	if err := m.Tree().Fill(leaves); err != nil {
+		return nil, nil, fmt.Errorf("stored chunk hashes do not match file %s: %w", fileID, err)
+	}
+	for _, leaf := range leaves {
+		if !s.Has(leaf) {
+			return nil, nil, fmt.Errorf("chunk %x of file %s is missing from the store", leaf, fileID)
+		}
+	}
+	return m, &storeSource{store: s, m: m, leaves: leaves, release: release}, nil
+}
+
+// Remove drops the record of a file, its chunks stay until GC finds nothing else uses them.
+// Fails with ErrFileServed while a source from Open is still open in any process
+func (s *Store) Remove(fileID string) error {
+	if err := checkFileID(fileID); err != nil {
+		return err
+	}
+	release, err := s.lock(false)
+	if err != nil {
+		return err
+	}
+	defer release()
+	unhold, err := s.hold(fileID, true)
+	if err != nil {
+		return err
+	}
+	defer unhold()
+
+	rec, err := s.record(fileID)
+	if err != nil {
+		return err
+	}
+	leaves, err := rec.leaves()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Remove(s.recordPath(fileID)); err != nil {
+		return fmt.Errorf("failed to remove file %s from store: %w", fileID, err)
+	}
+	// an Open waiting on the lock finds the record gone once it gets it
+	os.Remove(s.holdPath(fileID))
+	for _, leaf := range leaves {
+		if s.refs[leaf]--; s.refs[leaf] <= 0 {
+			delete(s.refs, leaf)
+		}
+	}
+	return nil
+}
+
+// Files lists every file in the store, sorted by name
+func (s *Store) Files() ([]StoredFile, error) {
+	records, err := s.records()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]StoredFile, 0, len(records))
+	for _, rec := range records {
+		out = append(out, StoredFile{ID: rec.Manifest.FileID(), Manifest: rec.Manifest})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Manifest.Name < out[j].Manifest.Name })
+	return out, nil
+}
+
+// Refs is how many chunks of stored files have this hash
+func (s *Store) Refs(hash [32]byte) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.refs[hash]
+}
+
+// GC deletes every chunk no stored file refers to, and leftovers of interrupted writes.
+// Waits for imports and removes in every process to finish, and counts references again from the records
+// on disk since other processes may have added or removed files since the store was opened.
+// returns how many chunks were removed and how many bytes that freed
+func (s *Store) GC() (int, int64, error) {
+	release, err := s.lock(true)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer release()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	refs, err := s.countRefs()
+	if err != nil {
+		return 0, 0, err
+	}
+	s.refs = refs
+
+	removed := 0
+	var freed int64
+	err = filepath.WalkDir(filepath.Join(s.dir, "chunks"), func(p string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		name := d.Name()
+		if !strings.HasPrefix(name, ".tmp-") {
+			hash, err := decodeHash(name)
+			if err != nil || s.refs[hash] > 0 {
+				return nil // not ours or still used
+			}
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+		removed++
+		freed += info.Size()
+		return nil
+	})
+	if err != nil {
+		return removed, freed, fmt.Errorf("failed to collect garbage: %w", err)
+	}
+	return removed, freed, nil
+}
+
+// the id becomes a path, only the canonical form of a valid id may get there
+func checkFileID(fileID string) error {
+	if id, err := ParseFileID(fileID); err != nil || id.String() != fileID {
+		return fmt.Errorf("file %s is not in the store", fileID)
+	}
+	return nil
+}
+
+func (s *Store) record(fileID string) (*storeRecord, error) {
+	if err := checkFileID(fileID); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(s.recordPath(fileID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("file %s is not in the store", fileID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read store record: %w", err)
+	}
+	var rec storeRecord
+	if err := json.Unmarshal(data, &rec); err != nil || rec.Manifest == nil {
+		return nil, fmt.Errorf("corrupt store record for %s", fileID)
+	}
+	return &rec, nil
+}
+
+func (s *Store) records() ([]*storeRecord, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, "files"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list store: %w", err)
+	}
+	var records []*storeRecord
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		rec, err := s.record(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+func (rec *storeRecord) leaves() ([][32]byte, error) {
+	leaves := make([][32]byte, len(rec.Leaves))
+	for i, h := range rec.Leaves {
+		leaf, err := decodeHash(h)
+		if err != nil {
+			return nil, fmt.Errorf("corrupt chunk hash in store record: %w", err)
+		}
+		leaves[i] = leaf
+	}
+	return leaves, nil
+}
+
+// storeSource reads the content of a stored file chunk by chunk
+type storeSource struct {
+	store     *Store
+	m         *Manifest
+	leaves    [][32]byte
+	release   func() // drops the hold on the file
+	closeOnce sync.Once
+}
+
+func (c *storeSource) Size() int64 {
+	return c.m.Size
+}
+
+func (c *storeSource) Close() error {
+	c.closeOnce.Do(c.release)
+	return nil
+}
+
+// ReadAt reads from the combined range, crossing chunk files as needed
+func (c *storeSource) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= c.m.Size {
+			return n, io.EOF
+		}
+		i := c.m.chunkAt(pos)
+		start, length := c.m.ChunkRange(i)
+		want := min64(int64(len(p)-n), start+int64(length)-pos)
+
+		f, err := os.Open(c.store.chunkPath(c.leaves[i]))
+		if err != nil {
+			return n, fmt.Errorf("failed to open chunk %d: %w", i, err)
+		}
+		m, err := f.ReadAt(p[n:n+int(want)], pos-start)
+		f.Close()
+		n += m
+		if err != nil && !(err == io.EOF && int64(m) == want) {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// writes a small file through a temporary file and rename so readers never see it half written
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package files
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// importTestFile writes data to a file, imports it into s and returns its manifest
+func importTestFile(t *testing.T, s *Store, name string, data []byte) *Manifest {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := BuildManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := OpenContent(path, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := s.Import(m, c); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func countChunks(t *testing.T, s *Store) int {
+	t.Helper()
+	n := 0
+	err := filepath.WalkDir(filepath.Join(s.Dir(), "chunks"), func(_ string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			n++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestStoreDedup(t *testing.T) {
+	s, err := OpenStore(filepath.Join(t.TempDir(), "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// b shares its first two chunks with a
+	a := make([]byte, 3*ChunkSize+11)
+	rand.Read(a)
+	b := append(append([]byte{}, a[:2*ChunkSize]...), make([]byte, ChunkSize+100)...)
+	ma := importTestFile(t, s, "a.bin", a)
+	mb := importTestFile(t, s, "b.bin", b)
+	if n := countChunks(t, s); n != 6 {
+		t.Fatalf("store holds %d chunks, want 6", n)
+	}
+
+	// importing again does not count the chunks twice
+	importTestFile(t, s, "a.bin", a)
+
+	m, src, err := s.Open(ma.FileID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(io.NewSectionReader(src, 0, m.Size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, a) {
+		t.Fatal("stored file reads back different data")
+	}
+
+	if err := s.Remove(mb.FileID()); err != nil {
+		t.Fatal(err)
+	}
+	removed, _, err := s.GC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Fatalf("gc removed %d chunks, want the 2 only b used", removed)
+	}
+
+	// a store opened again counts references from the records
+	s2, err := OpenStore(s.Dir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s2.Open(ma.FileID()); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s2.Open(mb.FileID()); err == nil {
+		t.Fatal("removed file can still be opened")
+	}
+	if removed, _, _ := s2.GC(); removed != 0 {
+		t.Fatalf("second gc removed %d chunks", removed)
+	}
+}
+
+func TestStoreGCSeesOtherStores(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "store")
+	a, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// b was opened before the import, its gc must not take the chunks
+	data := make([]byte, 2*ChunkSize)
+	rand.Read(data)
+	m := importTestFile(t, a, "a.bin", data)
+	if removed, _, err := b.GC(); err != nil || removed != 0 {
+		t.Fatalf("gc removed %d chunks of a file imported elsewhere (%v)", removed, err)
+	}
+	if _, _, err := a.Open(m.FileID()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoreRejectsBadIDs(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenStore(filepath.Join(dir, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := importTestFile(t, s, "a.bin", []byte("hello"))
+	victim := filepath.Join(dir, "victim.json")
+	if err := os.WriteFile(victim, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	id, _ := ParseFileID(m.FileID())
+	base58, _ := id.StringOfBase('z')
+	tests := []string{
+		"../../victim",
+		"../files/" + m.FileID(),
+		"",
+		base58, // the same file, but not the canonical form records are named by
+	}
+	for _, bad := range tests {
+		if _, _, err := s.Open(bad); err == nil {
+			t.Errorf("opened %q", bad)
+		}
+		if err := s.Remove(bad); err == nil {
+			t.Errorf("removed %q", bad)
+		}
+	}
+	if _, err := os.Stat(victim); err != nil {
+		t.Error("file outside the store was removed")
+	}
+	if _, _, err := s.Open(m.FileID()); err != nil {
+		t.Error("stored file is gone:", err)
+	}
+}
@@ -2,24 +2,44 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
-	"strconv"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/fatih/color"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/srivatsa-bot/bt-p2p/daemon"
 	"github.com/srivatsa-bot/bt-p2p/files"
 	"github.com/srivatsa-bot/bt-p2p/p2p"
 )
 
+func usage() {
+	fmt.Println("Usage:")
+	fmt.Println("  bt seed [-reprovide 1h] [-cdc] [-store] [-store-dir dir] <file|directory|file_id>...")
+	fmt.Println("  bt download [-pipeline 4] [-share=true] [-seed] [-min-peers 3] [-peer-wait 2m] [-reuse old_copy] [-store] [-store-dir dir] [-detach] <file_id|bt://link> [output_path]")
+	fmt.Println("  bt store [-dir dir] ls|rm <file_id>|gc")
+	fmt.Println("  bt daemon [-socket path] [-reprovide 1h]")
+	fmt.Println("  bt status")
+	fmt.Println("  bt pause|resume|cancel <download_id>")
+	fmt.Println("  bt id [-identity key_file] [-key-type ed25519|secp256k1] [-force] [show|gen|export [file]|import <file>]")
+	fmt.Println("  bt swarm-key [-force] gen|show [file]")
+	fmt.Println()
+	fmt.Println("seed, download and daemon also take the host flags [-identity key_file] [-key-type ed25519|secp256k1] [-ephemeral]")
+	fmt.Println("  [-config file] [-bootstrap multiaddr|none]... [-dht-prefix /name] [-listen multiaddr]... [-swarm-key file] [-mdns=true]")
+}
+
 func main() {
-	if len(os.Args) < 3 {
-		fmt.Println("Usage:")
-		fmt.Println("  bt seed <file>")
-		fmt.Println("  bt download <file_id> <chunk_count> <output_file>")
+	if len(os.Args) < 2 {
+		usage()
 		return
 	}
 
@@ -37,122 +57,752 @@ func main() {
 		cancel() //cancel the context leading to termination of go routines and other functions
 	}()
 
-	// Create host and dht
-	h, kad, err := p2p.CreateHost(ctx)
+	switch cmd {
+	case "seed":
+		seedCommand(ctx, os.Args[2:])
+	case "download":
+		downloadCommand(ctx, os.Args[2:])
+	case "store":
+		// The chunk store is local only, no host needed
+		storeCommand(os.Args[2:])
+	case "daemon":
+		daemonCommand(ctx, os.Args[2:])
+	case "status":
+		statusCommand(ctx)
+	case "pause", "resume", "cancel":
+		controlCommand(ctx, cmd, os.Args[2:])
+	case "id":
+		idCommand(os.Args[2:])
+	case "swarm-key":
+		swarmKeyCommand(os.Args[2:])
+	default:
+		fmt.Println("Unknown command:", cmd)
+		fmt.Println("Available commands: seed, download, store, daemon, status, pause, resume, cancel, id, swarm-key")
+	}
+}
+
+// connect returns the running daemon, or a node started in this process when there is none.
+// local is true for the in process node, it stops when the command exits
+func connect(ctx context.Context, reprovide time.Duration, hf *hostFlags) (api daemon.API, local bool) {
+	c, err := daemon.Dial(ctx, daemon.DefaultSocketPath())
+	if err != nil {
+		if errors.Is(err, daemon.ErrUnsafeSocket) {
+			log.Printf("%s %v", color.YellowString("Not using daemon:"), err)
+		}
+		return startNode(ctx, reprovide, hf), true
+	}
+	// the daemon stays in the network it was started in, a file meant for another one must not end up there
+	if err := hf.matchDaemon(ctx, c); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("%s %s", color.BlueString("Using daemon on"), daemon.DefaultSocketPath())
+	return c, false
+}
+
+// matchDaemon fails when the daemon runs with other network settings than the ones this command
+// was given by flags, environment or config file
+func (hf *hostFlags) matchDaemon(ctx context.Context, c *daemon.Client) error {
+	st, err := c.Status(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get daemon status: %w", err)
+	}
+	cfg := hf.settings()
+	opts, err := cfg.hostOptions()
+	if err != nil {
+		return err
+	}
+
+	diff := daemon.NewNetwork(opts, cfg.mdnsEnabled()).Diff(st.Network)
+	if *hf.ephemeral {
+		diff = append(diff, "identity (the daemon keeps its saved one)")
+	} else if *hf.identity != "" {
+		key, err := p2p.ReadIdentity(*hf.identity)
+		if err != nil {
+			return err
+		}
+		if id, err := peer.IDFromPrivateKey(key); err != nil || id.String() != st.PeerID {
+			diff = append(diff, "identity")
+		}
+	}
+	if len(diff) > 0 {
+		return fmt.Errorf("daemon on %s runs with different settings than this command asks for (%s). Run the command with the daemon's settings or stop the daemon first",
+			daemon.DefaultSocketPath(), strings.Join(diff, ", "))
+	}
+	return nil
+}
+
+// Creates host and dht and the node running on them
+func startNode(ctx context.Context, reprovide time.Duration, hf *hostFlags) *daemon.Node {
+	cfg := hf.settings()
+	opts, release := hf.options(cfg)
+	h, kad, err := p2p.CreateHost(ctx, opts)
 	if err != nil {
 		log.Fatal("Failed to create host:", err)
 	}
-	defer h.Close()
+	go func() {
+		<-ctx.Done()
+		h.Close()
+		release()
+	}()
 
-	switch cmd {
-	case "seed":
-		if len(os.Args) != 3 {
-			fmt.Println("Usage: bt seed <file>")
-			return
+	node, err := daemon.NewNode(ctx, h, kad, reprovide)
+	if err != nil {
+		log.Fatal(err)
+	}
+	node.SetNetwork(daemon.NewNetwork(opts, cfg.mdnsEnabled()))
+	if opts.ACL != nil {
+		node.SetACL(opts.ACL)
+		watchACL(ctx, opts.ACL)
+	}
+
+	// Peers on the same LAN find each other without bootstrap nodes
+	if cfg.mdnsEnabled() {
+		local, err := p2p.StartLocalDiscovery(ctx, h)
+		if err != nil {
+			log.Printf("Local discovery disabled: %v", err)
+		} else {
+			node.SetLocalPeers(local)
 		}
+	}
+	return node
+}
 
-		filePath := os.Args[2]
+// reloads the acl when its file changes or on SIGHUP
+func watchACL(ctx context.Context, acl *p2p.ACL) {
+	go acl.Watch(ctx)
 
-		// Check if file exists
-		if _, err := os.Stat(filePath); os.IsNotExist(err) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				if err := acl.Reload(); err != nil {
+					log.Printf("%s %v", color.RedString("Failed to reload acl, keeping the old rules:"), err)
+					continue
+				}
+				log.Printf("%s %s", color.GreenString("Reloaded acl:"), acl.Path())
+			}
+		}
+	}()
+}
+
+// host flags every command that starts a node takes
+type hostFlags struct {
+	fs        *flag.FlagSet
+	identity  *string
+	keyType   *string
+	ephemeral *bool
+	config    *string
+	bootstrap listFlag
+	dhtPrefix *string
+	listen    listFlag
+	swarmKey  *string
+	mdns      *bool
+	acl       *string
+}
+
+func addHostFlags(fs *flag.FlagSet) *hostFlags {
+	hf := &hostFlags{
+		fs:        fs,
+		identity:  fs.String("identity", "", "key file holding the peer identity, created on first run (default in the user config directory)"),
+		keyType:   fs.String("key-type", p2p.KeyTypeEd25519, "type of key created on first run, ed25519 or secp256k1"),
+		ephemeral: fs.Bool("ephemeral", false, "run with a new peer id that is not saved"),
+		config:    fs.String("config", "", "config file with bootstrap peers, dht prefix and listen addresses, BT_CONFIG sets the default"),
+		dhtPrefix: fs.String("dht-prefix", "", "run a private DHT under this protocol prefix, like /acme, apart from the IPFS one"),
+		swarmKey:  fs.String("swarm-key", "", "swarm key file of a private network, only peers with the same key can connect (default swarm.key in the user config directory when it exists)"),
+		mdns:      fs.Bool("mdns", true, "find peers on the local network with mDNS, BT_MDNS=false turns it off"),
+		acl:       fs.String("acl", "", "file with allow and deny lists of peer ids and CIDR ranges, reloaded when it changes (default acl.json in the user config directory when it exists)"),
+	}
+	fs.Var(&hf.bootstrap, "bootstrap", "bootstrap peer multiaddr with /p2p/<peer id>, repeat or separate with commas, none for no bootstrap")
+	fs.Var(&hf.listen, "listen", "multiaddr to listen on like /ip4/0.0.0.0/tcp/4001, repeat or separate with commas")
+	return hf
+}
+
+// settings reads the config file and lets the environment and then the flags override it
+func (hf *hostFlags) settings() config {
+	cfg, err := loadConfig(*hf.config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := cfg.applyEnv(); err != nil {
+		log.Fatal(err)
+	}
+	if len(hf.bootstrap) > 0 {
+		cfg.Bootstrap = hf.bootstrap
+	}
+	if *hf.dhtPrefix != "" {
+		cfg.DHTPrefix = *hf.dhtPrefix
+	}
+	if len(hf.listen) > 0 {
+		cfg.Listen = hf.listen
+	}
+	if *hf.swarmKey != "" {
+		cfg.SwarmKey = *hf.swarmKey
+	}
+	if *hf.acl != "" {
+		cfg.ACL = *hf.acl
+	}
+	hf.fs.Visit(func(f *flag.Flag) {
+		if f.Name == "mdns" {
+			cfg.MDNS = hf.mdns
+		}
+	})
+	return cfg
+}
+
+// options builds the host settings. It loads the identity and holds its lock until release.
+// When another bt process already runs with the key this one gets a temporary peer id,
+// two hosts with one id could not reach each other
+func (hf *hostFlags) options(cfg config) (opts p2p.HostOptions, release func()) {
+	opts, err := cfg.hostOptions()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *hf.ephemeral {
+		return opts, func() {}
+	}
+	path := identityPath(*hf.identity)
+	release, err = p2p.LockIdentity(path)
+	if errors.Is(err, p2p.ErrIdentityInUse) {
+		log.Printf("%s %s, using a temporary peer id", color.YellowString("Identity in use by another bt process:"), path)
+		return opts, func() {}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if opts.Identity, err = p2p.LoadIdentity(path, *hf.keyType); err != nil {
+		log.Fatal(err)
+	}
+	return opts, release
+}
+
+// identity key file, "" means the default location
+func identityPath(path string) string {
+	if path != "" {
+		return path
+	}
+	path, err := p2p.DefaultIdentityPath()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return path
+}
+
+// the daemon may run in another directory, every path sent to it is made absolute
+func absPath(p string) string {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return abs
+}
+
+func seedCommand(ctx context.Context, args []string) {
+	seedFlags := flag.NewFlagSet("seed", flag.ExitOnError)
+	reprovide := seedFlags.Duration("reprovide", p2p.DefaultReprovideInterval, "how often to re-announce seeded files on the DHT, a running daemon uses its own")
+	cdc := seedFlags.Bool("cdc", false, "split files into content defined chunks so new versions share chunks with old ones")
+	useStore := seedFlags.Bool("store", false, "import files into the chunk store and serve them from there, file ids already in the store can be seeded too")
+	storeDir := seedFlags.String("store-dir", "", "chunk store directory (default in the user cache directory)")
+	hf := addHostFlags(seedFlags)
+	seedFlags.Parse(args)
+
+	paths := seedFlags.Args()
+	if len(paths) == 0 {
+		fmt.Println("Usage: bt seed [-reprovide 1h] [-cdc] [-store] [-store-dir dir] <file|directory|file_id>...")
+		return
+	}
+
+	var store *files.Store
+	if *useStore {
+		store = openStore(*storeDir)
+	}
+
+	// Check every path exists before starting, with a store a path can also be a stored file id
+	requests := make([]daemon.SeedRequest, 0, len(paths))
+	for _, filePath := range paths {
+		req := daemon.SeedRequest{Path: filePath, CDC: *cdc, Store: *useStore}
+		if store != nil {
+			req.StoreDir = store.Dir()
+		}
+		if _, err := os.Stat(filePath); err == nil {
+			req.Path = absPath(filePath)
+		} else if !isStoredID(store, filePath) {
 			log.Fatal("File does not exist:", filePath)
 		}
+		requests = append(requests, req)
+	}
 
-		// Calculate chunk count
-		chunkCount, err := files.ChunkCount(filePath)
+	api, local := connect(ctx, *reprovide, hf)
+	for _, req := range requests {
+		// Builds and signs the manifest, registers the file and announces it
+		shared, err := api.Seed(ctx, req)
 		if err != nil {
-			log.Fatal("Failed to calculate chunks:", err)
+			log.Fatalf("Failed to seed %s: %v", req.Path, err)
+		}
+
+		if shared.Dir {
+			fmt.Printf("\n\n%s %s (%d files)\n", color.GreenString("Seeding directory:"), shared.Path, shared.Files)
+		} else {
+			fmt.Printf("\n\n%s %s\n", color.GreenString("Seeding file:"), shared.Path)
+		}
+		fmt.Printf("%s %s\n", color.GreenString("File ID:"), shared.FileID)
+		fmt.Printf("%s %d\n", color.GreenString("Total chunks:"), shared.Chunks)
+		fmt.Printf("%s %s\n", color.GreenString("To download:"), color.YellowString("bt download %s output_path", shared.FileID))
+		fmt.Printf("%s %s\n", color.GreenString("Share link:"), shared.Link)
+	}
+
+	if !local {
+		log.Printf("\n%s\n", color.RedString("Seeding in the daemon, it keeps serving after this command exits"))
+		return
+	}
+	log.Printf("\n%s\n", color.RedString("Seeding... Press Ctrl+C to stop"))
+	<-ctx.Done()
+}
+
+func downloadCommand(ctx context.Context, args []string) {
+	downloadFlags := flag.NewFlagSet("download", flag.ExitOnError)
+	pipeline := downloadFlags.Int("pipeline", p2p.DefaultPipelineDepth, "chunk requests in flight per peer stream")
+	share := downloadFlags.Bool("share", true, "serve verified chunks to other peers while downloading")
+	keepSeeding := downloadFlags.Bool("seed", false, "keep seeding after the download completes")
+	minPeers := downloadFlags.Int("min-peers", p2p.DefaultMinPeers, "search for more providers when fewer peers than this are active")
+	peerWait := downloadFlags.Duration("peer-wait", 2*time.Minute, "how long to wait for new providers when no peer has the remaining chunks")
+	reuse := downloadFlags.String("reuse", "", "older local copy of the content, chunks it shares with the download are copied instead of fetched")
+	useStore := downloadFlags.Bool("store", false, "import the finished download into the chunk store")
+	storeDir := downloadFlags.String("store-dir", "", "chunk store directory (default in the user cache directory)")
+	detach := downloadFlags.Bool("detach", false, "with a daemon running, start the download and return right away")
+	hf := addHostFlags(downloadFlags)
+	downloadFlags.Parse(args)
+
+	if downloadFlags.NArg() < 1 || downloadFlags.NArg() > 2 {
+		fmt.Println("Usage:")
+		fmt.Println("  bt download [-pipeline 4] [-share=true] [-seed] [-min-peers 3] [-peer-wait 2m] [-reuse old_copy] [-store] [-store-dir dir] [-detach] <file_id|bt://link> [output_path]")
+		return
+	}
+
+	// A share link carries the file id plus name, size, hash and seeders to dial first
+	target := downloadFlags.Arg(0)
+	output := downloadFlags.Arg(1)
+	if p2p.IsShareLink(target) {
+		link, err := p2p.ParseShareLink(target)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if output == "" {
+			output = link.Name
+		}
+	} else if _, err := files.ParseFileID(target); err != nil {
+		log.Fatal(err)
+	}
+	if output == "" {
+		log.Fatal("Output path is required unless the share link has a name")
+	}
+
+	req := daemon.DownloadRequest{
+		Target:   target,
+		Output:   absPath(output),
+		Pipeline: *pipeline,
+		Share:    *share,
+		Seed:     *keepSeeding,
+		MinPeers: *minPeers,
+		PeerWait: *peerWait,
+		Store:    *useStore,
+	}
+	if *reuse != "" {
+		req.Reuse = absPath(*reuse)
+	}
+	if *useStore {
+		req.StoreDir = openStore(*storeDir).Dir()
+	}
+
+	api, local := connect(ctx, p2p.DefaultReprovideInterval, hf)
+	info, err := api.StartDownload(ctx, req)
+	if err != nil {
+		log.Fatal("Failed to start download: ", err)
+	}
+	if !local {
+		log.Printf("%s %s", color.GreenString("Started download:"), info.ID)
+		if *detach {
+			log.Printf("Follow it with %s", color.YellowString("bt status"))
+			return
 		}
+	}
 
-		// Generate file hash as ID
-		hash, err := files.FileHash(filePath)
+	info = waitDownload(ctx, api, info.ID, !local)
+	switch info.State {
+	case daemon.StateCompleted:
+		if !local {
+			duration := info.Finished.Sub(info.Started)
+			log.Printf("%s %v!", color.BlueString("[Download completed successfully in:]"), duration)
+			log.Printf("%s %.2f MB/s", color.BlueString("[Average speed:]"), float64(info.BytesFetched)/(1024*1024)/duration.Seconds())
+		}
+		if *keepSeeding && local {
+			log.Printf("\n%s\n", color.RedString("Seeding... Press Ctrl+C to stop"))
+			<-ctx.Done()
+		}
+	case daemon.StateFailed:
+		log.Printf("%s", info.Error)
+		if len(info.FailedChunks) > 0 && !local {
+			log.Printf("Failed chunks: %v", info.FailedChunks)
+		}
+	default:
+		log.Printf("Download %s", info.State)
+	}
+}
+
+// waitDownload follows a download until it stops. progress is printed for a daemon download,
+// an in process one logs as it goes. Ctrl+C cancels the download
+func waitDownload(ctx context.Context, api daemon.API, id string, progress bool) daemon.DownloadInfo {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	canceled := false
+	lastDone := -1
+	for {
+		info, err := api.Download(context.Background(), id)
 		if err != nil {
-			log.Fatal("Failed to hash file:", err)
+			log.Fatal(err)
+		}
+		if info.Done() {
+			return info
+		}
+		if progress && info.ChunksDone != lastDone && info.Chunks > 0 {
+			log.Printf("%s %d/%d chunks, %d peer(s)", color.BlueString("[Progress]:"), info.ChunksDone, info.Chunks, info.Peers)
+			lastDone = info.ChunksDone
 		}
-		fileID := fmt.Sprintf("%x", hash)[:16] // Use first 16 chars of hash
 
-		fmt.Printf("\n\n%s %s\n", color.GreenString("Seeding file:"), filePath)
-		fmt.Printf("%s %s\n", color.GreenString("File ID:"), fileID)
-		fmt.Printf("%s %d\n", color.GreenString("Total chunks:"), chunkCount)
-		fmt.Printf("%s %s\n", color.GreenString("To download:"), color.YellowString("bt download %s %d output_file", fileID, chunkCount))
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if progress && !canceled {
+				canceled = true
+				if err := api.CancelDownload(context.Background(), id); err != nil {
+					log.Printf("Failed to cancel download: %v", err)
+				}
+			}
+			ticker.Reset(100 * time.Millisecond)
+		}
+	}
+}
+
+// bt daemon: one long lived host and DHT serving the control api, seed and download become clients of it
+func daemonCommand(ctx context.Context, args []string) {
+	daemonFlags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	socket := daemonFlags.String("socket", daemon.DefaultSocketPath(), "unix socket for the control api, BT_SOCKET sets the default")
+	reprovide := daemonFlags.Duration("reprovide", p2p.DefaultReprovideInterval, "how often to re-announce seeded files on the DHT")
+	hf := addHostFlags(daemonFlags)
+	daemonFlags.Parse(args)
+
+	node := startNode(ctx, *reprovide, hf)
+	if err := daemon.Serve(ctx, node, *socket); err != nil {
+		log.Fatal(err)
+	}
+}
 
-		// Handle file requests
-		if err := p2p.HandleFileRequest(h, filePath); err != nil {
-			log.Fatal("Failed to setup file handler:", err)
+// bt status: what the daemon serves and downloads
+func statusCommand(ctx context.Context) {
+	c, err := daemon.Dial(ctx, daemon.DefaultSocketPath())
+	if err != nil {
+		log.Fatal(err)
+	}
+	st, err := c.Status(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("%s %s\n", color.GreenString("[Peer ID]:"), st.PeerID)
+	for _, a := range st.Addrs {
+		fmt.Printf("%s %s\n", color.GreenString("[Address]:"), a)
+	}
+	fmt.Printf("%s %d\n", color.GreenString("[Local peers]:"), st.LocalPeers)
+	if st.Network.DHTPrefix != "" {
+		fmt.Printf("%s %s\n", color.GreenString("[Private DHT]:"), st.Network.DHTPrefix)
+	}
+	if st.Network.SwarmKey != "" {
+		fmt.Printf("%s swarm key %s\n", color.GreenString("[Private network]:"), st.Network.SwarmKey)
+	}
+	if st.Network.ACL != "" {
+		fmt.Printf("%s %s\n", color.GreenString("[ACL]:"), st.Network.ACL)
+	}
+	fmt.Printf("\n%s %d\n", color.BlueString("Seeding:"), len(st.Seeds))
+	for _, f := range st.Seeds {
+		state := "complete"
+		if !f.Complete {
+			state = "partial"
+		}
+		fmt.Printf("  %s %s (%d bytes, %s)\n", f.FileID, f.Name, f.Size, state)
+	}
+	fmt.Printf("\n%s %d\n", color.BlueString("Downloads:"), len(st.Downloads))
+	for _, d := range st.Downloads {
+		fmt.Printf("  [%s] %s %s %d/%d chunks, %d peer(s)\n", d.ID, d.State, d.Output, d.ChunksDone, d.Chunks, d.Peers)
+		if d.Error != "" {
+			fmt.Printf("      %s\n", color.RedString(d.Error))
 		}
+	}
+}
 
-		// Announce file
-		if err := p2p.AnnounceFile(ctx, kad, fileID); err != nil {
-			log.Fatal("Failed to announce file:", err)
+// bt pause|resume|cancel <id>: controls a download running in the daemon
+func controlCommand(ctx context.Context, cmd string, args []string) {
+	if len(args) != 1 {
+		fmt.Printf("Usage: bt %s <download_id>\n", cmd)
+		return
+	}
+	c, err := daemon.Dial(ctx, daemon.DefaultSocketPath())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var done string
+	switch cmd {
+	case "pause":
+		err, done = c.PauseDownload(ctx, args[0]), "Paused download:"
+	case "resume":
+		err, done = c.ResumeDownload(ctx, args[0]), "Resumed download:"
+	case "cancel":
+		err, done = c.CancelDownload(ctx, args[0]), "Canceled download:"
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s %s\n", color.GreenString(done), args[0])
+}
+
+// opens the chunk store, dir "" means the default location
+func openStore(dir string) *files.Store {
+	if dir == "" {
+		var err error
+		if dir, err = files.DefaultStoreDir(); err != nil {
+			log.Fatal(err)
 		}
+	}
+	store, err := files.OpenStore(dir)
+	if err != nil {
+		log.Fatal("Failed to open store: ", err)
+	}
+	return store
+}
 
-		log.Printf("\n%s\n", color.RedString("Seeding... Press Ctrl+C to stop"))
-		<-ctx.Done()
+// reports whether s names a file in the store
+func isStoredID(store *files.Store, s string) bool {
+	if store == nil {
+		return false
+	}
+	id, err := files.ParseFileID(s)
+	return err == nil && store.HasFile(id.String())
+}
 
-	case "download":
-		if len(os.Args) != 5 {
-			fmt.Println("Usage:")
-			fmt.Println("  bt download <file_id> <chunk_count> <output_file>")
+func mustStoredFiles(store *files.Store) []files.StoredFile {
+	stored, err := store.Files()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return stored
+}
+
+// bt store: list, remove and garbage collect files in the local chunk store
+func storeCommand(args []string) {
+	storeFlags := flag.NewFlagSet("store", flag.ExitOnError)
+	dir := storeFlags.String("dir", "", "chunk store directory (default in the user cache directory)")
+	storeFlags.Parse(args)
+
+	store := openStore(*dir)
+	switch storeFlags.Arg(0) {
+	case "ls":
+		for _, f := range mustStoredFiles(store) {
+			fmt.Printf("%s %s (%d bytes, %d chunks)\n", f.ID, f.Manifest.Name, f.Manifest.Size, f.Manifest.ChunkCount())
+		}
+
+	case "rm":
+		if storeFlags.NArg() != 2 {
+			fmt.Println("Usage: bt store [-dir dir] rm <file_id>")
 			return
 		}
+		id, err := files.ParseFileID(storeFlags.Arg(1))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := store.Remove(id.String()); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s %s, run %s to free its chunks\n", color.GreenString("Removed:"), id, color.YellowString("bt store gc"))
 
-		fileID := os.Args[2]
-		chunks, err := strconv.Atoi(os.Args[3])
+	case "gc":
+		removed, freed, err := store.GC()
 		if err != nil {
-			log.Fatal("Invalid chunk count:", os.Args[3])
+			log.Fatal(err)
 		}
-		output := os.Args[4]
+		fmt.Printf("%s %d chunks, %.2f MB freed\n", color.GreenString("Collected:"), removed, float64(freed)/(1024*1024))
 
-		log.Printf("\n\n%s: %s", color.GreenString("[Searching for file]"), fileID)
+	default:
+		fmt.Println("Usage: bt store [-dir dir] ls|rm <file_id>|gc")
+	}
+}
+
+// bt id: the peer id this machine runs with, and moving its key to another machine
+func idCommand(args []string) {
+	idFlags := flag.NewFlagSet("id", flag.ExitOnError)
+	identity := idFlags.String("identity", "", "key file holding the peer identity (default in the user config directory)")
+	keyType := idFlags.String("key-type", p2p.KeyTypeEd25519, "type of key to generate, ed25519 or secp256k1")
+	force := idFlags.Bool("force", false, "let gen and import replace an existing key, export overwrite its output file")
+	idFlags.Parse(args)
 
-		peers, err := p2p.FindProviders(ctx, kad, fileID)
+	path := identityPath(*identity)
+	switch idFlags.Arg(0) {
+	case "", "show":
+		// creates the key on first run like every other command
+		key, err := p2p.LoadIdentity(path, *keyType)
 		if err != nil {
-			log.Fatal("Failed to find providers:", err)
+			log.Fatal(err)
 		}
+		printIdentity(path, key)
 
-		log.Printf(color.BlueString("Found %d provider(s)"), len(peers))
+	case "gen":
+		refuseOverwrite(path, *force)
+		key, err := p2p.GenerateIdentity(*keyType)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := p2p.WriteIdentity(path, key); err != nil {
+			log.Fatal(err)
+		}
+		printIdentity(path, key)
 
-		// Create output file
-		outFile, err := os.Create(output)
+	case "export":
+		key, err := p2p.ReadIdentity(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		data, err := p2p.EncodeIdentity(key)
 		if err != nil {
-			log.Fatal("Failed to create output file:", err)
+			log.Fatal(err)
 		}
-		defer outFile.Close()
+		if idFlags.NArg() < 2 {
+			os.Stdout.Write(data)
+			return
+		}
+		flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+		if *force {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		}
+		f, err := os.OpenFile(idFlags.Arg(1), flags, 0600)
+		if err == nil {
+			_, err = f.Write(data)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			log.Fatal("Failed to export identity: ", err)
+		}
+		fmt.Printf("%s %s\n", color.GreenString("Exported identity to:"), idFlags.Arg(1))
 
-		// Pre-allocate file space for better performance
-		totalSize := int64(chunks) * 512 * 1024
-		if err := outFile.Truncate(totalSize); err != nil {
-			log.Printf("Warning: Failed to pre-allocate file space: %v", err)
+	case "import":
+		if idFlags.NArg() != 2 {
+			fmt.Println("Usage: bt id [-identity key_file] [-force] import <file|->")
+			return
+		}
+		var data []byte
+		var err error
+		if idFlags.Arg(1) == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(idFlags.Arg(1))
+		}
+		if err != nil {
+			log.Fatal("Failed to read key: ", err)
+		}
+		key, err := p2p.DecodeIdentity(data)
+		if err != nil {
+			log.Fatal(err)
 		}
+		refuseOverwrite(path, *force)
+		if err := p2p.WriteIdentity(path, key); err != nil {
+			log.Fatal(err)
+		}
+		printIdentity(path, key)
 
-		log.Printf(color.BlueString("Starting parallel download of %d chunks..."), chunks)
-		startTime := time.Now()
+	default:
+		fmt.Println("Usage: bt id [-identity key_file] [-key-type ed25519|secp256k1] [-force] [show|gen|export [file]|import <file>]")
+	}
+}
 
-		// Create parallel chunk downloader
-		downloader := p2p.NewChunkDownloader(h, peers, outFile, chunks)
+// a replaced key changes the peer id for good, only done when asked for
+func refuseOverwrite(path string, force bool) {
+	if _, err := os.Stat(path); err == nil && !force {
+		log.Fatalf("Identity %s already exists, -force replaces it and changes the peer id", path)
+	}
+}
 
-		// Start parallel download
-		if err := downloader.DownloadChunksParallel(ctx); err != nil {
-			log.Printf("Download completed with errors: %v", err)
+func printIdentity(path string, key crypto.PrivKey) {
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s %s\n", color.GreenString("[Peer ID]:"), id)
+	fmt.Printf("%s %s\n", color.GreenString("[Key type]:"), p2p.KeyTypeName(key))
+	fmt.Printf("%s %s\n", color.GreenString("[Key file]:"), path)
+}
 
-			// Show which chunks failed
-			failedChunks := downloader.GetFailedChunks()
-			if len(failedChunks) > 0 {
-				log.Printf("Failed chunks: %v", failedChunks)
-				log.Printf("You may need to retry or find more peers")
-			}
-		} else {
-			duration := time.Since(startTime)
-			log.Printf("%s %v!", color.BlueString("[Download completed successfully in:]"), duration)
+// bt swarm-key: makes the pre-shared key of a private network, copy the file to every machine in it
+func swarmKeyCommand(args []string) {
+	keyFlags := flag.NewFlagSet("swarm-key", flag.ExitOnError)
+	force := keyFlags.Bool("force", false, "replace an existing key file")
+	keyFlags.Parse(args)
 
-			// Calculate download speed
-			totalMB := float64(totalSize) / (1024 * 1024)
-			speedMBps := totalMB / duration.Seconds()
-			log.Printf("%s %.2f MB/s", color.BlueString("[Average speed:]"), speedMBps)
+	path := keyFlags.Arg(1)
+	if path == "" {
+		var err error
+		if path, err = p2p.DefaultSwarmKeyPath(); err != nil {
+			log.Fatal(err)
 		}
+	}
+
+	switch keyFlags.Arg(0) {
+	case "gen":
+		data, err := p2p.GenerateSwarmKey()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			log.Fatal(err)
+		}
+		flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+		if *force {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		}
+		f, err := os.OpenFile(path, flags, 0600)
+		if errors.Is(err, os.ErrExist) {
+			log.Fatalf("Swarm key %s already exists, -force replaces it and every peer needs the new one", path)
+		}
+		if err == nil {
+			_, err = f.Write(data)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			log.Fatal("Failed to write swarm key: ", err)
+		}
+		fmt.Printf("%s %s\n", color.GreenString("Wrote swarm key:"), path)
+		printSwarmKey(path)
+
+	case "show":
+		printSwarmKey(path)
 
 	default:
-		fmt.Println("Unknown command:", cmd)
-		fmt.Println("Available commands: seed, download")
+		fmt.Println("Usage: bt swarm-key [-force] gen|show [file]")
+	}
+}
+
+// the fingerprint tells whether two machines hold the same key without printing it
+func printSwarmKey(path string) {
+	psk, err := p2p.LoadSwarmKey(path)
+	if err != nil {
+		log.Fatal(err)
 	}
+	fmt.Printf("%s %s\n", color.GreenString("[Fingerprint]:"), p2p.SwarmKeyFingerprint(psk))
 }
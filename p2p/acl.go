@@ -0,0 +1,294 @@
+// access control: which peers may connect at all and which may fetch the files this node serves.
+// rules come from a json file that is reloaded when it changes, so a peer can be blocked without a restart
+package p2p
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// how often the acl file is checked for changes
+const aclReloadInterval = 10 * time.Second
+
+// ACLFile is the acl file. entries are peer ids, CIDR ranges or single ips
+//
+//	{
+//	  "deny":  ["203.0.113.0/24", "12D3KooW..."],
+//	  "serve": {"allow": ["10.0.0.0/8", "12D3KooW..."]}
+//	}
+type ACLFile struct {
+	Allow []string `json:"allow,omitempty"` // when set only these may connect, bootstrap and DHT peers included
+	Deny  []string `json:"deny,omitempty"`  // never connect, in either direction
+
+	Serve struct {
+		Allow []string `json:"allow,omitempty"` // when set only these get manifests and chunks
+		Deny  []string `json:"deny,omitempty"`
+	} `json:"serve"`
+}
+
+// Default location of the acl file, used when it exists
+func DefaultACLPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find config directory: %w", err)
+	}
+	return filepath.Join(dir, "bt", "acl.json"), nil
+}
+
+// peers and networks one list matches
+type aclList struct {
+	ids  map[peer.ID]bool
+	nets []*net.IPNet
+}
+
+func parseACLList(entries []string) (aclList, error) {
+	l := aclList{ids: make(map[peer.ID]bool)}
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if id, err := peer.Decode(e); err == nil {
+			l.ids[id] = true
+			continue
+		}
+		if _, n, err := net.ParseCIDR(e); err == nil {
+			l.nets = append(l.nets, n)
+			continue
+		}
+		if ip := net.ParseIP(e); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			l.nets = append(l.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		return l, fmt.Errorf("acl entry %q is not a peer id, CIDR range or ip", e)
+	}
+	return l, nil
+}
+
+func (l aclList) empty() bool {
+	return len(l.ids) == 0 && len(l.nets) == 0
+}
+
+func (l aclList) hasIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range l.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// an allow and a deny list, deny wins and an empty allow list lets everyone else in
+type aclRules struct {
+	allow, deny aclList
+}
+
+// allowed decides with what is known, id is "" and ip nil when not known yet.
+// final is false before the connection is secured, then an unknown id or ip that could still be on the allow list passes
+func (r aclRules) allowed(id peer.ID, ip net.IP, final bool) bool {
+	if (id != "" && r.deny.ids[id]) || r.deny.hasIP(ip) {
+		return false
+	}
+	if r.allow.empty() || (id != "" && r.allow.ids[id]) || r.allow.hasIP(ip) {
+		return true
+	}
+	if final {
+		return false
+	}
+	return (id == "" && len(r.allow.ids) > 0) || (ip == nil && len(r.allow.nets) > 0)
+}
+
+// allowedAddr is allowed with the ip taken from addr, nil when the address is not known yet.
+// a relayed connection shows the relays address, not the ip of the peer behind it, so relayed connections are
+// refused whenever networks are denied. otherwise a denied network would just go through a relay
+func (r aclRules) allowedAddr(id peer.ID, addr ma.Multiaddr, final bool) bool {
+	if isRelayed(addr) && len(r.deny.nets) > 0 {
+		return false
+	}
+	return r.allowed(id, remoteIP(addr), final)
+}
+
+// ACL is a connmgr.ConnectionGater for the host plus the check the seeder runs before serving a stream
+type ACL struct {
+	path string
+
+	mu      sync.RWMutex
+	connect aclRules
+	serve   aclRules
+	modTime time.Time
+	host    host.Host // set by CreateHost, peers denied by a reload are disconnected
+}
+
+// LoadACL reads the acl file at path
+func LoadACL(path string) (*ACL, error) {
+	a := &ACL{path: path}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload reads the file again, on error the rules in use are kept. Peers no longer allowed are disconnected
+func (a *ACL) Reload() error {
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return fmt.Errorf("failed to read acl: %w", err)
+	}
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return fmt.Errorf("failed to read acl: %w", err)
+	}
+	var f ACLFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("failed to parse acl %s: %w", a.path, err)
+	}
+
+	var connect, serve aclRules
+	lists := []struct {
+		entries []string
+		list    *aclList
+	}{
+		{f.Allow, &connect.allow}, {f.Deny, &connect.deny},
+		{f.Serve.Allow, &serve.allow}, {f.Serve.Deny, &serve.deny},
+	}
+	for _, l := range lists {
+		if *l.list, err = parseACLList(l.entries); err != nil {
+			return fmt.Errorf("invalid acl %s: %w", a.path, err)
+		}
+	}
+
+	a.mu.Lock()
+	a.connect, a.serve, a.modTime = connect, serve, info.ModTime()
+	h := a.host
+	a.mu.Unlock()
+
+	if h != nil {
+		a.disconnectDenied(h)
+	}
+	return nil
+}
+
+// Watch reloads the file whenever it changes until ctx ends
+func (a *ACL) Watch(ctx context.Context) {
+	ticker := time.NewTicker(aclReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(a.path)
+		a.mu.RLock()
+		changed := err == nil && !info.ModTime().Equal(a.modTime)
+		a.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := a.Reload(); err != nil {
+			log.Printf("%s %v", color.RedString("Failed to reload acl, keeping the old rules:"), err)
+			continue
+		}
+		log.Printf("%s %s", color.GreenString("Reloaded acl:"), a.path)
+	}
+}
+
+// Path is the file the rules come from
+func (a *ACL) Path() string {
+	return a.path
+}
+
+func (a *ACL) attach(h host.Host) {
+	a.mu.Lock()
+	a.host = h
+	a.mu.Unlock()
+}
+
+// closes connections the current rules would refuse
+func (a *ACL) disconnectDenied(h host.Host) {
+	for _, c := range h.Network().Conns() {
+		if !a.InterceptSecured(c.Stat().Direction, c.RemotePeer(), c) {
+			log.Printf("%s %s", color.RedString("Disconnecting peer denied by acl:"), c.RemotePeer())
+			c.Close()
+		}
+	}
+}
+
+// AllowServe reports whether the peer on the other end of a stream may get manifests and chunks
+func (a *ACL) AllowServe(s network.Stream) bool {
+	id, addr := s.Conn().RemotePeer(), s.Conn().RemoteMultiaddr()
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.connect.allowedAddr(id, addr, true) && a.serve.allowedAddr(id, addr, true)
+}
+
+func (a *ACL) InterceptPeerDial(p peer.ID) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.connect.allowed(p, nil, false)
+}
+
+func (a *ACL) InterceptAddrDial(p peer.ID, addr ma.Multiaddr) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.connect.allowedAddr(p, addr, false)
+}
+
+// the peer id of an incoming connection is only known once it is secured
+func (a *ACL) InterceptAccept(cm network.ConnMultiaddrs) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.connect.allowedAddr("", cm.RemoteMultiaddr(), false)
+}
+
+func (a *ACL) InterceptSecured(dir network.Direction, p peer.ID, cm network.ConnMultiaddrs) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.connect.allowedAddr(p, cm.RemoteMultiaddr(), true)
+}
+
+func (a *ACL) InterceptUpgraded(network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
+
+// reports whether addr goes through a relay
+func isRelayed(addr ma.Multiaddr) bool {
+	if addr == nil {
+		return false
+	}
+	_, err := addr.ValueForProtocol(ma.P_CIRCUIT)
+	return err == nil
+}
+
+// ip of the other end, nil for relayed connections since the address there belongs to the relay
+func remoteIP(addr ma.Multiaddr) net.IP {
+	if addr == nil || isRelayed(addr) {
+		return nil
+	}
+	ip, err := manet.ToIP(addr)
+	if err != nil {
+		return nil
+	}
+	return ip
+}
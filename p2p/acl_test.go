@@ -0,0 +1,202 @@
+package p2p
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/srivatsa-bot/bt-p2p/files"
+)
+
+const (
+	testPeerA = "12D3KooWQPswLiXVEAUf1WfKFRt3tBdydwqznWuTqa8UYtPwvFUv"
+	testPeerB = "12D3KooWMuCpD7LwnSFwhg2VmDnz5MP6Qhicuj7p1CfaCMMY6QKD"
+)
+
+func testRules(t *testing.T, allow, deny []string) aclRules {
+	t.Helper()
+	var r aclRules
+	var err error
+	if r.allow, err = parseACLList(allow); err != nil {
+		t.Fatal(err)
+	}
+	if r.deny, err = parseACLList(deny); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestParseACLList(t *testing.T) {
+	tests := []struct {
+		entry string
+		ok    bool
+	}{
+		{testPeerA, true},
+		{"10.0.0.0/8", true},
+		{"2001:db8::/32", true},
+		{"192.0.2.7", true},
+		{" 192.0.2.7 ", true},
+		{"::1", true},
+		{"example.com", false},
+		{"10.0.0.0/33", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if _, err := parseACLList([]string{tt.entry}); (err == nil) != tt.ok {
+			t.Errorf("%q: err %v, want ok %v", tt.entry, err, tt.ok)
+		}
+	}
+}
+
+func TestACLRules(t *testing.T) {
+	a, _ := peer.Decode(testPeerA)
+	b, _ := peer.Decode(testPeerB)
+	direct := ma.StringCast("/ip4/192.0.2.7/tcp/4001")
+	denied := ma.StringCast("/ip4/203.0.113.9/tcp/4001")
+	relayed := ma.StringCast("/ip4/192.0.2.7/tcp/4001/p2p/" + testPeerB + "/p2p-circuit")
+
+	tests := []struct {
+		name        string
+		allow, deny []string
+		id          peer.ID
+		addr        ma.Multiaddr
+		final       bool
+		want        bool
+	}{
+		{"no rules", nil, nil, a, direct, true, true},
+		{"denied id", nil, []string{testPeerA}, a, direct, true, false},
+		{"other id", nil, []string{testPeerA}, b, direct, true, true},
+		{"denied network", nil, []string{"203.0.113.0/24"}, a, denied, true, false},
+		{"outside denied network", nil, []string{"203.0.113.0/24"}, a, direct, true, true},
+		{"deny wins over allow", []string{testPeerA}, []string{testPeerA}, a, direct, true, false},
+		{"allowed id", []string{testPeerA}, nil, a, direct, true, true},
+		{"not on allow list", []string{testPeerA}, nil, b, direct, true, false},
+		{"allowed network", []string{"192.0.2.0/24"}, nil, b, direct, true, true},
+		{"id unknown before securing", []string{testPeerA}, nil, "", direct, false, true},
+		{"id unknown and secured", []string{testPeerA}, nil, "", direct, true, false},
+		{"address unknown before dialing", []string{"192.0.2.0/24"}, nil, b, nil, false, true},
+		{"relayed with denied networks", nil, []string{"203.0.113.0/24"}, a, relayed, true, false},
+		{"relayed before securing with denied networks", nil, []string{"203.0.113.0/24"}, "", relayed, false, false},
+		{"relayed with denied ids only", nil, []string{testPeerB}, a, relayed, true, true},
+		{"relayed denied id", nil, []string{testPeerA}, a, relayed, true, false},
+		{"relayed and only networks allowed", []string{"192.0.2.0/24"}, nil, a, relayed, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testRules(t, tt.allow, tt.deny)
+			if got := r.allowedAddr(tt.id, tt.addr, tt.final); got != tt.want {
+				t.Errorf("allowed %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	tests := []struct {
+		addr ma.Multiaddr
+		want net.IP
+	}{
+		{ma.StringCast("/ip4/192.0.2.7/tcp/4001"), net.ParseIP("192.0.2.7")},
+		{ma.StringCast("/ip6/2001:db8::1/udp/4001/quic-v1"), net.ParseIP("2001:db8::1")},
+		{ma.StringCast("/ip4/192.0.2.7/tcp/4001/p2p/" + testPeerB + "/p2p-circuit"), nil},
+		{ma.StringCast("/dns4/example.com/tcp/4001"), nil},
+		{nil, nil},
+	}
+	for _, tt := range tests {
+		if got := remoteIP(tt.addr); !got.Equal(tt.want) {
+			t.Errorf("%v: got %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestACLGater(t *testing.T) {
+	ctx := context.Background()
+	d := t.TempDir()
+	aclPath := filepath.Join(d, "acl.json")
+	writeACL := func(rules string) {
+		if err := os.WriteFile(aclPath, []byte(rules), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := LoadACL(aclPath); err == nil {
+		t.Error("missing acl file was accepted")
+	}
+	writeACL(`{"deny": ["not an entry"]}`)
+	if _, err := LoadACL(aclPath); err == nil {
+		t.Error("acl with a bad entry was accepted")
+	}
+
+	denied := newTestHost(t)
+	other := newTestHost(t)
+	writeACL(`{"serve": {"deny": ["` + denied.ID().String() + `"]}}`)
+	acl, err := LoadACL(aclPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seeder, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"), libp2p.ConnectionGater(acl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seeder.Close()
+	acl.attach(seeder)
+
+	src := filepath.Join(d, "src.bin")
+	writeTestFile(t, src, 1000)
+	m, err := files.BuildManifest(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := NewRegistry()
+	reg.SetACL(acl)
+	shareTestFile(t, seeder, reg, src, m)
+	HandleManifestRequest(seeder, reg)
+	peers := []peer.AddrInfo{{ID: seeder.ID(), Addrs: seeder.Addrs()}}
+
+	if _, err := FetchManifest(ctx, denied, peers, m.FileID()); err == nil {
+		t.Error("peer on the serve deny list got the manifest")
+	}
+	if _, err := FetchManifest(ctx, other, peers, m.FileID()); err != nil {
+		t.Fatal(err)
+	}
+
+	// a reload denying localhost drops every connection and refuses new ones both ways
+	writeACL(`{"deny": ["127.0.0.0/8"]}`)
+	if err := acl.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(seeder.Network().Conns()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := len(seeder.Network().Conns()); n != 0 {
+		t.Fatalf("%d connections left after the reload", n)
+	}
+	if err := seeder.Connect(ctx, peer.AddrInfo{ID: other.ID(), Addrs: other.Addrs()}); err == nil {
+		t.Error("seeder dialed a denied peer")
+	}
+
+	// a file that does not parse keeps the rules in use
+	writeACL(`{"deny": [`)
+	if err := acl.Reload(); err == nil {
+		t.Error("broken acl was accepted")
+	}
+	if acl.InterceptAccept(&testConnAddrs{ma.StringCast("/ip4/127.0.0.1/tcp/4001")}) {
+		t.Error("old rules were dropped by a failed reload")
+	}
+}
+
+// testConnAddrs is the network.ConnMultiaddrs of a connection from remote
+type testConnAddrs struct {
+	remote ma.Multiaddr
+}
+
+func (c *testConnAddrs) LocalMultiaddr() ma.Multiaddr  { return ma.StringCast("/ip4/127.0.0.1/tcp/1") }
+func (c *testConnAddrs) RemoteMultiaddr() ma.Multiaddr { return c.remote }
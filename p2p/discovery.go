@@ -3,7 +3,6 @@ package p2p
 
 import (
 	"context"
-	"crypto/sha256"
 	"fmt"
 	"log"
 	"time"
@@ -12,96 +11,141 @@ import (
 	"github.com/ipfs/go-cid"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	peer "github.com/libp2p/go-libp2p/core/peer"
-	mh "github.com/multiformats/go-multihash"
+	"github.com/srivatsa-bot/bt-p2p/files"
 )
 
-// Creates a proper content id from a string.
-// DTH identifies files in network through this cid
-func createCID(s string) (cid.Cid, error) {
-	// Hash the string
-	hash := sha256.Sum256([]byte(s))
+// Turns a file id into the cid the DHT knows the file by.
+// The file id already is a cid of the content, it is used as is
+func createCID(fileID string) (cid.Cid, error) {
+	return files.ParseFileID(fileID)
+}
 
-	// Create a multihash(protocol+hash length+hash) from the hash
-	mhash, err := mh.EncodeName(hash[:], "sha2-256")
+func AnnounceFile(ctx context.Context, kad *dht.IpfsDHT, fileID string) error {
+	c, err := provideFile(ctx, kad, fileID)
 	if err != nil {
-		return cid.Undef, fmt.Errorf("failed to create multihash: %w", err)
+		return err
 	}
 
-	// Create CID v1
-	c := cid.NewCidV1(cid.Raw, mhash)
-	return c, nil
+	log.Printf("\n%s: %s\n", color.GreenString("Announced file"), c.String())
+	return nil
 }
 
-func AnnounceFile(ctx context.Context, kad *dht.IpfsDHT, fileID string) error {
-	key := "/bt/file/" + fileID
-
-	// Create proper cid for the dht key, values are peer id
-	c, err := createCID(key)
+// puts this node in the dht as a provider of the file, returns the cid it used
+func provideFile(ctx context.Context, kad *dht.IpfsDHT, fileID string) (cid.Cid, error) {
+	// the cid is the dht key, values are peer ids
+	c, err := createCID(fileID)
 	if err != nil {
-		return fmt.Errorf("failed to create CID for file %s: %w", fileID, err)
+		return cid.Undef, fmt.Errorf("failed to create CID for file %s: %w", fileID, err)
 	}
 
 	//provides other peers dth with cid
-	err = kad.Provide(ctx, c, true)
-	if err != nil {
-		return fmt.Errorf("failed to announce file %s: %w", fileID, err)
+	if err := kad.Provide(ctx, c, true); err != nil {
+		return c, fmt.Errorf("failed to announce file %s: %w", fileID, err)
 	}
-
-	log.Printf("\n%s: %s (CID: %s)\n", color.GreenString("Announced file"), key, c.String())
-	return nil
+	return c, nil
 }
 
+// how many providers a single search asks the dht for
+const maxProviders = 10
+
+// background searches ask for more, a download can use as many peers as it finds
+const maxWatchedProviders = 50
+
+// how often the background search runs again during a download
+const providerSearchInterval = 2 * time.Minute
+
+// least time between two background searches, even when the downloader keeps running low
+const minProviderSearchGap = 10 * time.Second
+
 // finds the peers with the specific cid from dth
 func FindProviders(ctx context.Context, kad *dht.IpfsDHT, fileID string) ([]peer.AddrInfo, error) {
-	key := "/bt/file/" + fileID
+	var results []peer.AddrInfo
+	err := searchProviders(ctx, kad, fileID, maxProviders, func(p peer.AddrInfo) {
+		results = append(results, p)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("no providers found for file %s", fileID)
+	}
+	return results, nil
+}
+
+// WatchProviders keeps searching the dht for providers of the file until ctx ends and feeds
+// every provider it finds into the downloader. a new search runs every providerSearchInterval,
+// or sooner when the downloader signals that its active peers dropped below the minimum
+func WatchProviders(ctx context.Context, kad *dht.IpfsDHT, fileID string, cd *ChunkDownloader) {
+	ticker := time.NewTicker(providerSearchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-cd.PeersLow():
+			log.Printf("%s %d active peer(s), searching for more providers", color.YellowString("Running low on peers:"), cd.ActivePeers())
+		}
+
+		err := searchProviders(ctx, kad, fileID, maxWatchedProviders, func(p peer.AddrInfo) {
+			cd.AddPeer(p)
+		})
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Background provider search failed: %v", err)
+		}
 
-	// Create proper CID for the key
-	c, err := createCID(key)
+		// dont hammer the dht when peers keep dropping
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(minProviderSearchGap):
+		}
+	}
+}
+
+// runs one provider search for up to 30 seconds and calls found for every provider with addresses
+func searchProviders(ctx context.Context, kad *dht.IpfsDHT, fileID string, limit int, found func(peer.AddrInfo)) error {
+	c, err := createCID(fileID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create CID for file %s: %w", fileID, err)
+		return fmt.Errorf("failed to create CID for file %s: %w", fileID, err)
 	}
 
-	log.Printf("%s: %s (CID: %s)\n", color.GreenString("[Searching for providers of]"), key, c.String())
+	log.Printf("%s: %s\n", color.GreenString("[Searching for providers of]"), c.String())
 
 	//context with timeout for provider search
 	searchCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
 	//gets peerid and stores them in channel
-	provChan := kad.FindProvidersAsync(searchCtx, c, 10)
-
-	var results []peer.AddrInfo
-	timeout := time.After(30 * time.Second)
+	provChan := kad.FindProvidersAsync(searchCtx, c, limit)
 
 	for {
 		select {
 		case p, ok := <-provChan:
 			if !ok {
-				// Channel closed, return results
-				if len(results) == 0 {
-					return nil, fmt.Errorf("no providers found for file %s", fileID)
-				}
-				return results, nil
+				// Channel closed, search is over
+				return nil
 			}
 			// If no addresses, try to resolve
 			if len(p.Addrs) == 0 {
-				info, err := kad.FindPeer(ctx, p.ID)
+				info, err := kad.FindPeer(searchCtx, p.ID)
 				if err == nil && len(info.Addrs) > 0 {
 					p.Addrs = info.Addrs
 				}
 			}
 			if len(p.Addrs) > 0 {
 				fmt.Printf("%s %s\n", color.BlueString("Found provider:"), p.ID)
-				results = append(results, p)
+				found(p)
 			} else {
 				log.Printf("Found provider %s but no addresses", p.ID)
 			}
 
-		case <-timeout:
-			if len(results) == 0 {
-				return nil, fmt.Errorf("timeout: no providers found for file %s", fileID)
+		case <-searchCtx.Done():
+			if ctx.Err() != nil {
+				return ctx.Err()
 			}
-			return results, nil
+			return nil
 		}
 	}
 }
@@ -5,57 +5,168 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/fatih/color"
 	libp2p "github.com/libp2p/go-libp2p"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
 	peer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/pnet"
 	"github.com/libp2p/go-libp2p/core/protocol"
 	ma "github.com/multiformats/go-multiaddr"
 )
 
 const ProtocolID = protocol.ID("/bt/file/1.0.0")
 
-func CreateHost(ctx context.Context) (host.Host, *dht.IpfsDHT, error) {
+// HostOptions are the settings CreateHost builds the host with, the zero value joins the public IPFS DHT
+type HostOptions struct {
+	Identity crypto.PrivKey // peer key, nil makes a new peer id for this run only (see LoadIdentity)
+	Listen   []string       // multiaddrs to listen on, libp2p picks random ports when empty
+
+	// peers to join the DHT through. nil means the public IPFS bootstrap nodes for the public DHT
+	// and none for a private one, an empty slice means none
+	Bootstrap []peer.AddrInfo
+
+	// runs the DHT as <prefix>/kad/1.0.0 instead of /ipfs/kad/1.0.0. nodes with another prefix
+	// never answer each other, so a team swarm is kept apart from the IPFS network and its file ids stay in it
+	DHTPrefix protocol.ID
+
+	// pre-shared key of a libp2p private network (see LoadSwarmKey). every connection is encrypted with it,
+	// peers without the key cant even finish the handshake. only tcp and websocket work with a key
+	PSK pnet.PSK
+
+	// allow and deny lists checked on every connection in both directions (see LoadACL),
+	// peers denied by a reload are disconnected
+	ACL *ACL
+}
+
+// PrivateDHT reports whether the host runs its own DHT apart from the IPFS one
+func (o HostOptions) PrivateDHT() bool {
+	return o.DHTPrefix != "" && o.DHTPrefix != dht.DefaultPrefix
+}
+
+// BootstrapPeers are the peers CreateHost joins the DHT through, the public IPFS nodes
+// when none are set for the public DHT
+func (o HostOptions) BootstrapPeers() []peer.AddrInfo {
+	if o.Bootstrap == nil && !o.PrivateDHT() && o.PSK == nil {
+		return dht.GetDefaultBootstrapPeerAddrInfos()
+	}
+	return o.Bootstrap
+}
+
+// Parses /ip4/.../p2p/<peer id> style addresses, addresses of one peer are merged
+func ParseBootstrapPeers(addrs []string) ([]peer.AddrInfo, error) {
+	maddrs := make([]ma.Multiaddr, 0, len(addrs))
+	for _, a := range addrs {
+		m, err := ma.NewMultiaddr(a)
+		if err == nil {
+			_, err = peer.AddrInfoFromP2pAddr(m) // has to name the peer to dial
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid bootstrap address %q: %w", a, err)
+		}
+		maddrs = append(maddrs, m)
+	}
+	infos, err := peer.AddrInfosFromP2pAddrs(maddrs...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bootstrap address: %w", err)
+	}
+	return infos, nil
+}
+
+func CreateHost(ctx context.Context, opts HostOptions) (host.Host, *dht.IpfsDHT, error) {
+	if opts.DHTPrefix != "" && !strings.HasPrefix(string(opts.DHTPrefix), "/") {
+		return nil, nil, fmt.Errorf("dht prefix must start with /: %q", opts.DHTPrefix)
+	}
+	bootstrap := opts.BootstrapPeers()
+	if opts.PSK != nil {
+		// the IPFS bootstrap nodes are not in any private network, dialing them would only fail
+		for _, info := range dht.GetDefaultBootstrapPeerAddrInfos() {
+			for _, b := range bootstrap {
+				if b.ID == info.ID {
+					return nil, nil, fmt.Errorf("bootstrap peer %s is a public IPFS node and cant join a private network, use bootstrap peers that hold the swarm key", b.ID)
+				}
+			}
+		}
+	}
 
 	//host(nodes unique identity on network) creation
-	h, err := libp2p.New(
+	hostOpts := []libp2p.Option{
 		libp2p.NATPortMap(),
 		libp2p.EnableAutoNATv2(),    // Discover public IP and reachability.
 		libp2p.EnableHolePunching(), // Attempt to punch holes through NATs for direct connections.
 		libp2p.EnableRelayService(), // Enable this node to act as a relay
 		libp2p.EnableRelay(),        // Enable this node to use relays
-	)
+	}
+	if opts.Identity != nil {
+		hostOpts = append(hostOpts, libp2p.Identity(opts.Identity)) // same peer id every run, saved multiaddrs keep working
+	}
+	if len(opts.Listen) > 0 {
+		hostOpts = append(hostOpts, libp2p.ListenAddrStrings(opts.Listen...)) // fixed ports, needed by a node others bootstrap from
+	} else if opts.PSK != nil {
+		hostOpts = append(hostOpts, libp2p.ListenAddrStrings("/ip4/0.0.0.0/tcp/0", "/ip6/::/tcp/0")) // quic and webrtc cant carry a psk
+	}
+	if opts.PSK != nil {
+		hostOpts = append(hostOpts, libp2p.PrivateNetwork(opts.PSK))
+	}
+	if opts.ACL != nil {
+		hostOpts = append(hostOpts, libp2p.ConnectionGater(opts.ACL))
+	}
+	h, err := libp2p.New(hostOpts...)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to create libp2p host: %w", err)
 	}
+	if opts.ACL != nil {
+		opts.ACL.attach(h)
+	}
 	//Distributed Hash Table creation(register for nodes) Kademila in this instance
-	kad, err := dht.New(ctx, h, dht.Mode(dht.ModeServer)) //Modeserver option is used so node can store dth reacords nd respond to other peers queries
+	dhtOpts := []dht.Option{
+		dht.Mode(dht.ModeServer),         //Modeserver option is used so node can store dth reacords nd respond to other peers queries
+		dht.BootstrapPeers(bootstrap...), // dialed again whenever the routing table runs empty
+	}
+	if opts.PrivateDHT() {
+		dhtOpts = append(dhtOpts, dht.ProtocolPrefix(opts.DHTPrefix))
+	}
+	kad, err := dht.New(ctx, h, dhtOpts...)
 	if err != nil {
 		h.Close()
 		return nil, nil, fmt.Errorf("failed to create DHT: %w", err)
 	}
 
 	// Connect to bootstrap peers(well maintained nodes that help new peers join into network)
-	connected := 0
-	for _, addr := range dht.DefaultBootstrapPeers {
-		info, err := peer.AddrInfoFromP2pAddr(addr) //fetches peerid from multiaddress
-		if err != nil {
-			log.Printf("Failed to parse bootstrap peer %s: %v\n", addr, err)
-			continue
+	connected, rejected := 0, 0
+	for _, info := range bootstrap {
+		if info.ID == h.ID() {
+			continue // a shared config lists the bootstrap node itself too
 		}
 		//pining bootstrap peers
-		if err := h.Connect(ctx, *info); err != nil {
+		if err := h.Connect(ctx, info); err != nil {
 			log.Printf("%s %s: %v\n", color.RedString("Bootstrap failed for"), info.ID, err)
+			if isHandshakeError(err) {
+				rejected++
+				if opts.PSK != nil {
+					log.Printf("%s %s is not in this private network or has another swarm key", color.RedString("Handshake failed:"), info.ID)
+				} else {
+					log.Printf("%s %s may run a private network, load its swarm key with -swarm-key", color.RedString("Handshake failed:"), info.ID)
+				}
+			}
 		} else {
 			log.Printf("%s %s\n", color.GreenString("Connected to bootstrap peer:"), info.ID)
 			connected++
 		}
 	}
 
-	if connected == 0 {
+	if len(bootstrap) == 0 {
+		log.Println("No bootstrap peers configured, other peers have to connect to this one")
+	} else if connected == 0 && rejected > 0 && opts.PSK != nil {
+		// every bootstrap peer that answered refused the key, the swarm is misconfigured rather than down
+		kad.Close()
+		h.Close()
+		return nil, nil, fmt.Errorf("no bootstrap peer accepted the swarm key (fingerprint %s), they are not in this private network", SwarmKeyFingerprint(opts.PSK))
+	} else if connected == 0 {
 		log.Println("Warning!!!: No bootstrap peers connected")
 	}
 
@@ -67,8 +178,25 @@ func CreateHost(ctx context.Context) (host.Host, *dht.IpfsDHT, error) {
 
 	// Wait a bit for DHT to initialize and populate with discovered peers
 	time.Sleep(2 * time.Second)
+	// peers that connected but run the DHT under another prefix never enter the routing table
+	if connected > 0 && kad.RoutingTable().Size() == 0 {
+		prefix := opts.DHTPrefix
+		if !opts.PrivateDHT() {
+			prefix = dht.DefaultPrefix
+		}
+		log.Printf("Warning!!!: Bootstrap peers do not run the DHT under %s", prefix)
+	}
 	fmt.Printf("%s", color.BlueString("\n[Client Node Info]\n"))
 	fmt.Printf("%s %s\n", color.GreenString("[Peer ID]:"), h.ID())
+	if opts.PrivateDHT() {
+		fmt.Printf("%s %s\n", color.GreenString("[Private DHT]:"), opts.DHTPrefix)
+	}
+	if opts.PSK != nil {
+		fmt.Printf("%s swarm key %s\n", color.GreenString("[Private network]:"), SwarmKeyFingerprint(opts.PSK))
+	}
+	if opts.ACL != nil {
+		fmt.Printf("%s %s\n", color.GreenString("[ACL]:"), opts.ACL.Path())
+	}
 	//loop through list of ip of this node and adds your Peer ID to each address to form a multiaddress.
 	// This address will be recorded in other peers dht's. eg /ipv4/port/p2p/peerid
 	for _, addr := range h.Addrs() {
@@ -78,3 +206,9 @@ func CreateHost(ctx context.Context) (host.Host, *dht.IpfsDHT, error) {
 
 	return h, kad, nil
 }
+
+// the security handshake is the first thing a private network changes, a peer with another key
+// or none at all fails there. libp2p only reports it in the error text
+func isHandshakeError(err error) bool {
+	return strings.Contains(err.Error(), "failed to negotiate security protocol")
+}
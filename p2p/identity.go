@@ -0,0 +1,135 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+// key types a new identity can be generated with
+const (
+	KeyTypeEd25519   = "ed25519"
+	KeyTypeSecp256k1 = "secp256k1"
+)
+
+// returned by LockIdentity when another bt process runs with the same key
+var ErrIdentityInUse = errors.New("identity is in use by another process")
+
+// Default location of the identity key, under the user config directory
+func DefaultIdentityPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find config directory: %w", err)
+	}
+	return filepath.Join(dir, "bt", "identity.key"), nil
+}
+
+// GenerateIdentity makes a new private key of keyType, the peer id is derived from it
+func GenerateIdentity(keyType string) (crypto.PrivKey, error) {
+	var typ int
+	switch strings.ToLower(keyType) {
+	case KeyTypeEd25519, "":
+		typ = crypto.Ed25519
+	case KeyTypeSecp256k1:
+		typ = crypto.Secp256k1
+	default:
+		return nil, fmt.Errorf("unknown key type %q, use %s or %s", keyType, KeyTypeEd25519, KeyTypeSecp256k1)
+	}
+	key, _, err := crypto.GenerateKeyPair(typ, -1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate %s key: %w", keyType, err)
+	}
+	return key, nil
+}
+
+// LoadIdentity reads the key at path. On first run there is none yet,
+// a new key of keyType is generated and written there so the peer id stays the same across restarts
+func LoadIdentity(path, keyType string) (crypto.PrivKey, error) {
+	key, err := ReadIdentity(path)
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return key, err
+	}
+
+	key, err = GenerateIdentity(keyType)
+	if err != nil {
+		return nil, err
+	}
+	if err := WriteIdentity(path, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ReadIdentity reads a key written by WriteIdentity
+func ReadIdentity(path string) (crypto.PrivKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity: %w", err)
+	}
+	key, err := DecodeIdentity(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity %s: %w", path, err)
+	}
+	return key, nil
+}
+
+// WriteIdentity stores the key at path readable by the owner only, an existing key is replaced
+func WriteIdentity(path string, key crypto.PrivKey) error {
+	data, err := EncodeIdentity(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create identity directory: %w", err)
+	}
+
+	// written next to the key and renamed over it, a crash never leaves half a key behind
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-identity-*")
+	if err != nil {
+		return fmt.Errorf("failed to write identity: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write identity: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write identity: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write identity: %w", err)
+	}
+	return nil
+}
+
+// EncodeIdentity is the key file format: the libp2p protobuf encoding of the key in base64, one line
+func EncodeIdentity(key crypto.PrivKey) ([]byte, error) {
+	raw, err := crypto.MarshalPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode key: %w", err)
+	}
+	return []byte(crypto.ConfigEncodeKey(raw) + "\n"), nil
+}
+
+// DecodeIdentity reads a key file. The raw protobuf encoding other libp2p tools export is accepted too
+func DecodeIdentity(data []byte) (crypto.PrivKey, error) {
+	raw, err := crypto.ConfigDecodeKey(string(bytes.TrimSpace(data)))
+	if err != nil {
+		raw = data
+	}
+	key, err := crypto.UnmarshalPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("not a private key: %w", err)
+	}
+	return key, nil
+}
+
+// KeyTypeName names the type of key in lower case, like ed25519
+func KeyTypeName(key crypto.PrivKey) string {
+	return strings.ToLower(key.Type().String())
+}
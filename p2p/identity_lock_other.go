@@ -0,0 +1,8 @@
+//go:build !unix
+
+package p2p
+
+// No flock outside unix, every process may use the key
+func LockIdentity(path string) (release func(), err error) {
+	return func() {}, nil
+}
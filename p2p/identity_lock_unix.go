@@ -0,0 +1,32 @@
+//go:build unix
+
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// LockIdentity marks the key at path as used by this process until release is called.
+// Two hosts with one peer id cant dial each other and confuse the DHT, so a second process gets ErrIdentityInUse.
+// The lock is dropped by the kernel when the process dies
+func LockIdentity(path string) (release func(), err error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create identity directory: %w", err)
+	}
+	f, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock identity: %w", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrIdentityInUse
+		}
+		return nil, fmt.Errorf("failed to lock identity: %w", err)
+	}
+	return func() { f.Close() }, nil
+}
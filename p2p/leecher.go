@@ -2,181 +2,636 @@ package p2p
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fatih/color"
 	"github.com/libp2p/go-libp2p/core/host"
 	peer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/srivatsa-bot/bt-p2p/files"
 )
 
+// upper bound on chunks being fetched at once across all peers
+const maxDownloadWorkers = 32
+
+// a chunk is given up on after failing this many rounds over all peers
+const maxChunkAttempts = 3
+
+// how often peers are asked again which chunks they have
+const bitfieldRefreshInterval = 30 * time.Second
+
+// below this many active peers the downloader asks discovery for more
+const DefaultMinPeers = 3
+
+// an endgame request found every peer with the chunk already busy with it
+var errNoSparePeer = errors.New("no spare peer for chunk")
+
+// every peer asked for a chunk was still cooling down from earlier failures, not the chunks fault
+var errPeersCooling = errors.New("only peers cooling down were asked")
+
 // ChunkDownloader manages parallel chunk downloads
 type ChunkDownloader struct {
 	host        host.Host
 	peers       []peer.AddrInfo
-	outFile     *os.File
-	chunkLocks  []sync.Mutex // Individual mutex for each chunk
-	downloaded  []bool       // Track which chunks are downloaded
-	failed      []int        // Track failed chunks for retry
-	failedMutex sync.Mutex   // Protect failed slice
+	peerMutex   sync.Mutex // Protect peers, providers found later are added while downloading
+	out         *files.Content
+	manifest    *files.Manifest
+	chunkLocks  []sync.Mutex   // Held while a verified chunk is written so only the first copy lands
+	downloaded  files.Bitfield // Track which chunks are downloaded and verified
+	haveMutex   sync.Mutex     // Protect downloaded bitfield
+	resume      *resumeWriter  // Resume sidecar next to the output, flushed in batches
+	failed      []int          // Chunks given up on
+	attempts    map[int]int    // Failed attempts per chunk
+	failedMutex sync.Mutex     // Protect failed slice and attempts
+	scores      *scoreboard    // Per peer speed and failures, decides which peer is asked first
+	received    atomic.Int64   // Verified bytes fetched from peers in this run
 	totalChunks int
-	maxWorkers  int
+
+	sessions      map[peer.ID]*peerSession // One pipelined stream per peer
+	sessionMutex  sync.Mutex               // Protect sessions map
+	pipelineDepth int                      // Outstanding requests per peer stream
+	picker        *piecePicker             // Rarest first chunk selection
+	onVerified    func(chunkID int)        // Called after each chunk is written and verified
+	races         map[int]*chunkRace       // Requests running per chunk, several in endgame
+	raceMutex     sync.Mutex               // Protect races map
+
+	minPeers    int             // Below this many active peers discovery is asked for more
+	peerWait    time.Duration   // How long to wait for new providers when no peer has what is left
+	peersLow    chan struct{}   // Signalled when active peers drop below minPeers
+	peerAdded   chan struct{}   // Signalled when a new peer is ready during a download
+	runCtx      context.Context // Set while DownloadChunksParallel runs
+	workers     sync.WaitGroup
+	workerCount int
+	workerMutex sync.Mutex // Protect runCtx and workerCount
+}
+
+// chunkRace is every request running for one chunk. the first verified reply cancels the rest
+type chunkRace struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	refs   int
+	peers  map[peer.ID]bool // peers already asked for this chunk
 }
 
 // NewChunkDownloader creates a new parallel chunk downloader
-func NewChunkDownloader(h host.Host, peers []peer.AddrInfo, outFile *os.File, totalChunks int) *ChunkDownloader {
+func NewChunkDownloader(h host.Host, peers []peer.AddrInfo, out *files.Content, manifest *files.Manifest) *ChunkDownloader {
+	totalChunks := manifest.ChunkCount()
+	statePath := resumePath(out.Path())
+
+	// Pick up chunks finished by an earlier run of the same download
+	downloaded, err := loadResumeState(statePath, manifest, out)
+	if err != nil {
+		log.Printf("Ignoring resume state: %v", err)
+	} else if n := downloaded.Count(); n > 0 {
+		log.Printf("%s %d/%d chunks already downloaded", color.GreenString("Resuming:"), n, totalChunks)
+	}
+
+	// our own provider record can show up once we re-serve chunks, never download from ourselves
+	others := make([]peer.AddrInfo, 0, len(peers))
+	for _, pi := range peers {
+		if pi.ID != h.ID() {
+			others = append(others, pi)
+		}
+	}
+	peers = others
+
 	return &ChunkDownloader{
 		host:        h,
 		peers:       peers,
-		outFile:     outFile,
+		out:         out,
+		manifest:    manifest,
 		chunkLocks:  make([]sync.Mutex, totalChunks),
-		downloaded:  make([]bool, totalChunks),
+		downloaded:  downloaded,
+		resume:      newResumeWriter(statePath, manifest, downloaded),
 		failed:      make([]int, 0),
+		attempts:    make(map[int]int),
+		scores:      newScoreboard(),
 		totalChunks: totalChunks,
-		maxWorkers:  min(10, len(peers)*2), // Limit concurrent workers
+
+		sessions:      make(map[peer.ID]*peerSession),
+		pipelineDepth: DefaultPipelineDepth,
+		races:         make(map[int]*chunkRace),
+
+		minPeers:  DefaultMinPeers,
+		peersLow:  make(chan struct{}, 1),
+		peerAdded: make(chan struct{}, 1),
 	}
 }
 
-// DownloadChunksParallel downloads all chunks using goroutines
+// DownloadChunksParallel downloads all missing chunks using goroutines, rarest chunks first
 func (cd *ChunkDownloader) DownloadChunksParallel(ctx context.Context) error {
-	// Create job channel for chunk IDs
-	jobs := make(chan int, cd.totalChunks)
+	defer cd.closeSessions()
+	defer cd.flushResumeState()
+
+	// Ask every peer which chunks it has before picking anything
+	cd.picker = newPiecePicker(cd.totalChunks, cd.Downloaded())
+	cd.refreshBitfields(ctx)
+
+	// Keep bitfields fresh while downloading, partial seeders gain chunks over time
+	refreshCtx, stopRefresh := context.WithCancel(ctx)
+	defer stopRefresh()
+	go cd.refreshLoop(refreshCtx)
+
+	cd.workerMutex.Lock()
+	cd.runCtx = ctx
+	cd.workerMutex.Unlock()
+	defer func() {
+		cd.workerMutex.Lock()
+		cd.runCtx = nil
+		cd.workerMutex.Unlock()
+	}()
 
-	// Worker group
-	var wg sync.WaitGroup
+	for {
+		cd.startWorkers(false)
 
-	// Start workers
-	for i := 0; i < cd.maxWorkers; i++ {
-		wg.Add(1)
-		go cd.worker(ctx, jobs, &wg)
-	}
+		// Wait for all workers to complete
+		cd.workers.Wait()
 
-	// Send all chunk IDs to jobs channel
-	go func() {
-		defer close(jobs)
-		for i := 0; i < cd.totalChunks; i++ {
-			select {
-			case jobs <- i:
-			case <-ctx.Done():
-				return
-			}
+		// workers stop early when no peer has what is left, give discovery a chance to find one
+		if ctx.Err() != nil || cd.peerWait == 0 || len(cd.picker.remaining()) == 0 || !cd.waitForPeers(ctx) {
+			break
 		}
-	}()
+	}
 
-	// Wait for all workers to complete
-	wg.Wait()
+	for _, line := range cd.scores.summary() {
+		log.Printf("%s %s", color.BlueString("[Peer]"), line)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	// Retry failed chunks
-	if len(cd.failed) > 0 {
-		log.Printf("Retrying %d failed chunks...", len(cd.failed))
-		return cd.retryFailedChunks(ctx)
+	// Whatever the picker still holds was not offered by any peer
+	for _, chunkID := range cd.picker.remaining() {
+		if !cd.isDownloaded(chunkID) && !cd.isFailed(chunkID) {
+			cd.addFailedChunk(chunkID)
+		}
+	}
+	cd.dropRecovered()
+
+	if failed := cd.GetFailedChunks(); len(failed) > 0 {
+		return fmt.Errorf("%d chunks could not be downloaded", len(failed))
 	}
 
 	return nil
 }
 
-// worker processes chunk download jobs
-func (cd *ChunkDownloader) worker(ctx context.Context, jobs <-chan int, wg *sync.WaitGroup) {
-	defer wg.Done()
+// startWorkers starts workers up to the limit for the current number of peers. grow only adds to a pool
+// that is still running: once every worker stopped, workers.Add would race the download loop's Wait, and the
+// loop restarts them itself. Nothing is started after the run ended
+func (cd *ChunkDownloader) startWorkers(grow bool) {
+	cd.workerMutex.Lock()
+	defer cd.workerMutex.Unlock()
+	if cd.runCtx == nil || (grow && cd.workerCount == 0) {
+		return
+	}
+	for cd.workerCount < cd.workerLimit() {
+		cd.workerCount++
+		cd.workers.Add(1)
+		go cd.worker(cd.runCtx)
+	}
+}
+
+// workerLimit is how many chunks may be fetched at once, every peer's pipeline full but never more than maxDownloadWorkers
+func (cd *ChunkDownloader) workerLimit() int {
+	return min(maxDownloadWorkers, len(cd.peerList())*cd.pipelineDepth)
+}
+
+// waitForPeers blocks until discovery adds a peer, false if none shows up within peerWait
+func (cd *ChunkDownloader) waitForPeers(ctx context.Context) bool {
+	log.Printf("%s waiting up to %v for new providers", color.YellowString("No peer has the remaining chunks,"), cd.peerWait)
+	cd.signalPeersLow()
+
+	timer := time.NewTimer(cd.peerWait)
+	defer timer.Stop()
+	select {
+	case <-cd.peerAdded:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// worker keeps asking the picker for the next chunk until there is nothing left
+func (cd *ChunkDownloader) worker(ctx context.Context) {
+	defer func() {
+		// count drops before Done so startWorkers never adds to a group that is being waited on at zero
+		cd.workerMutex.Lock()
+		cd.workerCount--
+		cd.workerMutex.Unlock()
+		cd.workers.Done()
+	}()
 
 	for {
-		select {
-		case chunkID, ok := <-jobs:
-			if !ok {
-				return // Channel closed
-			}
+		chunkID, dup, ok := cd.picker.next(ctx)
+		if !ok {
+			return
+		}
 
-			// Skip if already downloaded
-			if cd.downloaded[chunkID] {
-				continue
+		// Try to download chunk from available peers
+		err := cd.downloadChunk(ctx, chunkID, dup)
+		if err == nil {
+			cd.picker.done(chunkID)
+			continue
+		}
+		if ctx.Err() != nil {
+			cd.picker.release(chunkID)
+			return
+		}
+
+		// a duplicate failing is fine, the first request for the chunk is still running and handles retries
+		if dup {
+			if errors.Is(err, errNoSparePeer) {
+				cd.picker.stopDuplicates(chunkID)
 			}
+			cd.picker.release(chunkID)
+			continue
+		}
+
+		// failing on peers that were already failing says nothing about the chunk, dont count it
+		if errors.Is(err, errPeersCooling) {
+			cd.picker.release(chunkID)
+			continue
+		}
+
+		if cd.recordAttempt(chunkID) >= maxChunkAttempts {
+			log.Printf("Giving up on chunk %d: %v", chunkID, err)
+			cd.addFailedChunk(chunkID)
+			cd.picker.done(chunkID)
+		} else {
+			log.Printf("Failed to download chunk %d, will retry: %v", chunkID, err)
+			cd.picker.release(chunkID)
+		}
+	}
+}
+
+// refreshBitfields asks every peer for its bitfield, v1 peers are skipped
+func (cd *ChunkDownloader) refreshBitfields(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, pi := range cd.peerList() {
+		if cd.scores.isDropped(pi.ID) {
+			continue
+		}
+		wg.Add(1)
+		go func(pi peer.AddrInfo) {
+			defer wg.Done()
+			cd.refreshBitfield(ctx, pi)
+		}(pi)
+	}
+	wg.Wait()
+}
+
+func (cd *ChunkDownloader) refreshBitfield(ctx context.Context, pi peer.AddrInfo) {
+	reqCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
 
-			// Try to download chunk from available peers
-			if err := cd.downloadChunk(ctx, chunkID); err != nil {
-				log.Printf("Failed to download chunk %d: %v", chunkID, err)
-				cd.addFailedChunk(chunkID)
+	// a bitfield is small, its round trip is a good latency sample
+	start := time.Now()
+	have, err := cd.session(pi).bitfield(reqCtx, cd.manifest.FileID(), cd.totalChunks)
+	if errors.Is(err, errV1Only) {
+		if cd.scores.markV1Only(pi.ID) {
+			cd.skipV1Peer(pi.ID)
+		}
+		return
+	}
+	if err != nil {
+		// one failed refresh says nothing about what the peer has, it keeps its last bitfield.
+		// a peer that never answered is assumed to have everything so it still gets asked
+		log.Printf("Failed to get bitfield from peer %s: %v", pi.ID, err)
+		cd.picker.assumeFull(pi.ID)
+		return
+	}
+	cd.scores.latencySample(pi.ID, time.Since(start))
+	cd.picker.setPeerHave(pi.ID, have)
+}
+
+// AddPeer adds a provider found after the download was set up. during a download the peer
+// is asked for its bitfield and put to work straight away. returns false for peers already known
+func (cd *ChunkDownloader) AddPeer(pi peer.AddrInfo) bool {
+	if pi.ID == cd.host.ID() {
+		return false
+	}
+
+	cd.peerMutex.Lock()
+	known := false
+	for _, p := range cd.peers {
+		if p.ID == pi.ID {
+			known = true
+			break
+		}
+	}
+	if !known {
+		cd.peers = append(cd.peers, pi)
+	}
+	cd.peerMutex.Unlock()
+
+	// a peer that went away and is announced again gets another chance
+	if known && !cd.scores.revive(pi.ID) {
+		return false
+	}
+	log.Printf("%s %s", color.BlueString("Adding provider:"), pi.ID)
+
+	cd.workerMutex.Lock()
+	ctx := cd.runCtx
+	cd.workerMutex.Unlock()
+	if ctx != nil {
+		go func() {
+			cd.refreshBitfield(ctx, pi)
+			cd.retryFailed()
+			cd.startWorkers(true)
+
+			select {
+			case cd.peerAdded <- struct{}{}:
+			default:
 			}
+		}()
+	}
+	return true
+}
+
+// ActivePeers counts the peers that are neither dropped nor cooling down after failures
+func (cd *ChunkDownloader) ActivePeers() int {
+	return cd.scores.active(cd.peerList())
+}
+
+// PeersLow is signalled whenever the number of active peers drops below the minimum
+func (cd *ChunkDownloader) PeersLow() <-chan struct{} {
+	return cd.peersLow
+}
+
+func (cd *ChunkDownloader) signalPeersLow() {
+	select {
+	case cd.peersLow <- struct{}{}:
+	default:
+	}
+}
+
+// SetMinPeers sets the number of active peers below which PeersLow is signalled
+func (cd *ChunkDownloader) SetMinPeers(n int) {
+	cd.minPeers = n
+}
+
+// SetPeerWait sets how long a download waits for new providers once no known peer has what is left.
+// zero, the default, fails the remaining chunks right away
+func (cd *ChunkDownloader) SetPeerWait(d time.Duration) {
+	cd.peerWait = d
+}
+
+// snapshot of the peers, safe to range over while peers are added
+func (cd *ChunkDownloader) peerList() []peer.AddrInfo {
+	cd.peerMutex.Lock()
+	defer cd.peerMutex.Unlock()
+	return append([]peer.AddrInfo(nil), cd.peers...)
+}
 
+func (cd *ChunkDownloader) refreshLoop(ctx context.Context) {
+	ticker := time.NewTicker(bitfieldRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
 		case <-ctx.Done():
 			return
+		case <-ticker.C:
+			cd.refreshBitfields(ctx)
 		}
 	}
 }
 
-// downloadChunk attempts to download a specific chunk from available peers
-func (cd *ChunkDownloader) downloadChunk(ctx context.Context, chunkID int) error {
-	// Lock this specific chunk
-	cd.chunkLocks[chunkID].Lock()
-	defer cd.chunkLocks[chunkID].Unlock()
-
-	// Double-check if chunk was downloaded while waiting for lock
-	if cd.downloaded[chunkID] {
+// downloadChunk attempts to download a specific chunk from available peers.
+// dup is an extra endgame request, it goes to a peer no other request for the chunk has asked
+func (cd *ChunkDownloader) downloadChunk(ctx context.Context, chunkID int, dup bool) error {
+	if cd.isDownloaded(chunkID) {
 		return nil
 	}
 
-	// Try each peer until successful
-	for _, peerInfo := range cd.peers {
-		if err := cd.requestChunkFromPeer(ctx, peerInfo, chunkID); err != nil {
+	race := cd.joinRace(ctx, chunkID)
+	defer cd.leaveRace(chunkID)
+
+	// Try each peer that has the chunk until successful, fastest first
+	asked, fresh := false, false
+	for _, peerInfo := range cd.scores.rank(cd.peerList(), cd.manifest.ChunkSize) {
+		if !cd.picker.hasChunk(peerInfo.ID, chunkID) || !cd.claimPeer(race, peerInfo.ID) {
+			continue
+		}
+		asked = true
+		fresh = fresh || !cd.scores.isCooling(peerInfo.ID)
+
+		if err := cd.requestChunkFromPeer(race.ctx, peerInfo, chunkID, dup); err != nil {
+			if cd.isDownloaded(chunkID) {
+				// another request for this chunk won and cancelled this one
+				return nil
+			}
+			if errors.Is(err, files.ErrHashMismatch) {
+				// peer is banned by now, move on to the next provider
+				log.Printf("%s %d from peer %s", color.RedString("Corrupt chunk"), chunkID, peerInfo.ID)
+				continue
+			}
 			log.Printf("Failed to download chunk %d from peer %s: %v", chunkID, peerInfo.ID, err)
 			continue
 		}
 
-		// Mark as downloaded
-		cd.downloaded[chunkID] = true
-		log.Printf("%s %d", color.GreenString("Successfully downloaded chunk"), chunkID)
+		// first verified copy is in, stop the duplicates
+		race.cancel()
 		return nil
 	}
 
+	if dup && !asked {
+		return errNoSparePeer
+	}
+	if asked && !fresh {
+		return fmt.Errorf("failed to download chunk %d: %w", chunkID, errPeersCooling)
+	}
 	return fmt.Errorf(color.RedString("failed to download chunk %d from all peers"), chunkID)
 }
 
-// requestChunkFromPeer downloads a chunk from a specific peer
-func (cd *ChunkDownloader) requestChunkFromPeer(ctx context.Context, pi peer.AddrInfo, chunkID int) error {
-	// Connect to peer with timeout
-	connectCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
-	defer cancel()
+// requestChunkFromPeer downloads a chunk from a specific peer. only the first verified copy of a chunk is written
+func (cd *ChunkDownloader) requestChunkFromPeer(ctx context.Context, pi peer.AddrInfo, chunkID int, dup bool) error {
+	var data []byte
+	var proof files.MerkleProof
+	var err error
+	start := cd.scores.begin(pi.ID)
+	if dup {
+		// duplicates get their own stream so the loser can be reset without breaking the pipeline
+		data, proof, err = fetchChunkOnce(ctx, cd.host, pi, cd.manifest.FileID(), chunkID)
+	} else {
+		// Requests go over the peers long lived stream, pipelined with other workers' requests
+		data, proof, err = cd.session(pi).fetch(ctx, cd.manifest.FileID(), chunkID)
+	}
 
-	if err := cd.host.Connect(connectCtx, pi); err != nil {
-		return fmt.Errorf("failed to connect to peer %s: %w", pi.ID, err)
+	// Never write anything the merkle root does not vouch for
+	if err == nil {
+		err = cd.manifest.VerifyChunk(chunkID, data, proof)
+	}
+	cd.scored(pi.ID, cd.scores.end(pi.ID, start, len(data), err))
+	if err != nil {
+		return err
 	}
 
-	// Create stream with timeout
-	streamCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
-	defer cancel()
+	cd.chunkLocks[chunkID].Lock()
+	defer cd.chunkLocks[chunkID].Unlock()
+	if cd.isDownloaded(chunkID) {
+		return nil // lost the race, drop this copy
+	}
 
-	s, err := cd.host.NewStream(streamCtx, pi.ID, ProtocolID)
-	if err != nil {
-		return fmt.Errorf("stream creation failed: %w", err)
+	// Write to file at correct offset, may span several files for a directory
+	offset, _ := cd.manifest.ChunkRange(chunkID)
+	if _, err := cd.out.WriteAt(data, offset); err != nil {
+		return fmt.Errorf("failed to write chunk to file: %w", err)
 	}
-	defer s.Close()
+	cd.received.Add(int64(len(data)))
 
-	// Set deadlines
-	s.SetWriteDeadline(time.Now().Add(10 * time.Second))
-	s.SetReadDeadline(time.Now().Add(30 * time.Second))
+	// Mark as downloaded
+	cd.markDownloaded(chunkID)
+	log.Printf("%s %d", color.GreenString("Successfully downloaded chunk"), chunkID)
+	return nil
+}
 
-	// Send chunk request
-	if _, err := fmt.Fprintf(s, "%d\n", chunkID); err != nil {
-		return fmt.Errorf("failed to send chunk request: %w", err)
+// joinRace returns the requests shared state for a chunk, creating it for the first request
+func (cd *ChunkDownloader) joinRace(ctx context.Context, chunkID int) *chunkRace {
+	cd.raceMutex.Lock()
+	defer cd.raceMutex.Unlock()
+	race, ok := cd.races[chunkID]
+	if !ok {
+		raceCtx, cancel := context.WithCancel(ctx)
+		race = &chunkRace{ctx: raceCtx, cancel: cancel, peers: make(map[peer.ID]bool)}
+		cd.races[chunkID] = race
 	}
+	race.refs++
+	return race
+}
 
-	// Read response into buffer
-	buf := make([]byte, 512*1024)
-	n, err := io.ReadFull(s, buf)
-	if err != nil && err != io.ErrUnexpectedEOF {
-		return fmt.Errorf("failed to read chunk data: %w", err)
+// leaveRace drops a request, the last one out cleans up so a retry starts with every peer again
+func (cd *ChunkDownloader) leaveRace(chunkID int) {
+	cd.raceMutex.Lock()
+	defer cd.raceMutex.Unlock()
+	race := cd.races[chunkID]
+	race.refs--
+	if race.refs == 0 {
+		race.cancel()
+		delete(cd.races, chunkID)
 	}
+}
 
-	// Write to file at correct offset
-	offset := int64(chunkID) * 512 * 1024
-	if _, err := cd.outFile.WriteAt(buf[:n], offset); err != nil {
-		return fmt.Errorf("failed to write chunk to file: %w", err)
+// claimPeer reserves a peer for one request of the race, false if another request already asked it
+func (cd *ChunkDownloader) claimPeer(race *chunkRace, id peer.ID) bool {
+	cd.raceMutex.Lock()
+	defer cd.raceMutex.Unlock()
+	if race.peers[id] {
+		return false
+	}
+	race.peers[id] = true
+	return true
+}
+
+// scored drops a peer the scoreboard just gave up on, result comes from end or reject
+func (cd *ChunkDownloader) scored(id peer.ID, result int) {
+	switch result {
+	case peerBanned:
+		log.Printf("%s %s", color.RedString("Banning peer for sending corrupt data:"), id)
+		cd.dropPeer(id)
+	case peerGone:
+		log.Printf("%s %s", color.YellowString("Dropping peer after repeated failures:"), id)
+		cd.dropPeer(id)
+	case peerV1Only:
+		cd.skipV1Peer(id)
 	}
+}
 
-	return nil
+// skipV1Peer drops a peer that only speaks v1. v1 sends chunks without merkle proofs so none of them could be verified
+func (cd *ChunkDownloader) skipV1Peer(id peer.ID) {
+	log.Printf("%s %s, it only speaks %s which sends chunks without merkle proofs", color.YellowString("Skipping peer"), id, ProtocolID)
+	cd.dropPeer(id)
+}
+
+// dropPeer stops picking chunks for a peer and asks discovery for more when peers run low.
+// before the download started, while reusing chunks, there is no picker yet and the scoreboard alone keeps it out
+func (cd *ChunkDownloader) dropPeer(id peer.ID) {
+	if cd.picker != nil {
+		cd.picker.removePeer(id)
+	}
+	if cd.ActivePeers() < cd.minPeers {
+		cd.signalPeersLow()
+	}
+}
+
+// session returns the pipelined session for a peer, opening one on first use
+func (cd *ChunkDownloader) session(pi peer.AddrInfo) *peerSession {
+	cd.sessionMutex.Lock()
+	defer cd.sessionMutex.Unlock()
+	ps, ok := cd.sessions[pi.ID]
+	if !ok {
+		ps = newPeerSession(cd.host, pi, cd.pipelineDepth)
+		cd.sessions[pi.ID] = ps
+	}
+	return ps
+}
+
+// closeSessions closes every peer stream once the download is over
+func (cd *ChunkDownloader) closeSessions() {
+	cd.sessionMutex.Lock()
+	defer cd.sessionMutex.Unlock()
+	for id, ps := range cd.sessions {
+		ps.close()
+		delete(cd.sessions, id)
+	}
+}
+
+// SetPipelineDepth sets how many requests may be outstanding on each peer's stream, call before downloading
+func (cd *ChunkDownloader) SetPipelineDepth(depth int) {
+	if depth < 1 {
+		depth = 1
+	}
+	cd.pipelineDepth = depth
+}
+
+// isDownloaded reports whether a chunk is already written and verified
+func (cd *ChunkDownloader) isDownloaded(chunkID int) bool {
+	cd.haveMutex.Lock()
+	defer cd.haveMutex.Unlock()
+	return cd.downloaded.Has(chunkID)
+}
+
+// markDownloaded records a verified chunk, the resume file is written outside haveMutex so workers dont wait on the disk
+func (cd *ChunkDownloader) markDownloaded(chunkID int) {
+	cd.haveMutex.Lock()
+	cd.downloaded.Set(chunkID)
+	cd.haveMutex.Unlock()
+
+	if err := cd.resume.add(chunkID); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	if cd.onVerified != nil {
+		cd.onVerified(chunkID)
+	}
+}
+
+// flushResumeState writes chunks still waiting for the next batch, so stopping keeps every verified chunk
+func (cd *ChunkDownloader) flushResumeState() {
+	if err := cd.resume.close(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
+
+// ClearResumeState removes the resume file once the download is complete
+func (cd *ChunkDownloader) ClearResumeState() error {
+	return cd.resume.clear()
+}
+
+// BytesDownloaded returns how many verified bytes were fetched from peers, resumed chunks are not counted
+func (cd *ChunkDownloader) BytesDownloaded() int64 {
+	return cd.received.Load()
+}
+
+// VerifyFile checks the downloaded file against the full file hash and merkle root in the manifest
+func (cd *ChunkDownloader) VerifyFile() error {
+	return cd.manifest.VerifyFile(io.NewSectionReader(cd.out, 0, cd.manifest.Size))
 }
 
 // addFailedChunk adds a chunk ID to the failed list
@@ -186,44 +641,64 @@ func (cd *ChunkDownloader) addFailedChunk(chunkID int) {
 	cd.failed = append(cd.failed, chunkID)
 }
 
-// retryFailedChunks retries downloading failed chunks
-func (cd *ChunkDownloader) retryFailedChunks(ctx context.Context) error {
+// recordAttempt counts a failed attempt at a chunk and returns how many there were so far
+func (cd *ChunkDownloader) recordAttempt(chunkID int) int {
 	cd.failedMutex.Lock()
-	retryList := make([]int, len(cd.failed))
-	copy(retryList, cd.failed)
-	cd.failed = cd.failed[:0] // Clear failed list
-	cd.failedMutex.Unlock()
-
-	// Retry with fewer workers
-	retryWorkers := min(3, len(cd.peers))
-	jobs := make(chan int, len(retryList))
-	var wg sync.WaitGroup
+	defer cd.failedMutex.Unlock()
+	cd.attempts[chunkID]++
+	return cd.attempts[chunkID]
+}
 
-	// Start retry workers
-	for i := 0; i < retryWorkers; i++ {
-		wg.Add(1)
-		go cd.worker(ctx, jobs, &wg)
+// isFailed reports whether a chunk was given up on
+func (cd *ChunkDownloader) isFailed(chunkID int) bool {
+	cd.failedMutex.Lock()
+	defer cd.failedMutex.Unlock()
+	for _, id := range cd.failed {
+		if id == chunkID {
+			return true
+		}
 	}
+	return false
+}
 
-	// Send failed chunks to retry
-	go func() {
-		defer close(jobs)
-		for _, chunkID := range retryList {
-			select {
-			case jobs <- chunkID:
-			case <-ctx.Done():
-				return
-			}
-		}
-	}()
+// retryFailed gives chunks that were given up on another round of attempts
+func (cd *ChunkDownloader) retryFailed() {
+	cd.failedMutex.Lock()
+	ids := cd.failed
+	cd.failed = make([]int, 0)
+	for _, id := range ids {
+		delete(cd.attempts, id)
+	}
+	cd.failedMutex.Unlock()
 
-	wg.Wait()
+	if len(ids) > 0 {
+		cd.picker.reopen(ids)
+	}
+}
 
-	if len(cd.failed) > 0 {
-		return fmt.Errorf("still have %d failed chunks after retry", len(cd.failed))
+// dropRecovered forgets given up chunks that an endgame duplicate still fetched afterwards
+func (cd *ChunkDownloader) dropRecovered() {
+	cd.failedMutex.Lock()
+	defer cd.failedMutex.Unlock()
+	failed := cd.failed[:0]
+	for _, id := range cd.failed {
+		if !cd.isDownloaded(id) {
+			failed = append(failed, id)
+		}
 	}
+	cd.failed = failed
+}
 
-	return nil
+// OnChunkVerified sets a callback run after every chunk is written and verified, used to re-serve chunks
+func (cd *ChunkDownloader) OnChunkVerified(fn func(chunkID int)) {
+	cd.onVerified = fn
+}
+
+// Downloaded returns a copy of the bitfield of chunks written and verified so far
+func (cd *ChunkDownloader) Downloaded() files.Bitfield {
+	cd.haveMutex.Lock()
+	defer cd.haveMutex.Unlock()
+	return append(files.Bitfield(nil), cd.downloaded...)
 }
 
 // GetFailedChunks returns the list of chunks that failed to download
@@ -0,0 +1,143 @@
+// share links bundle everything a leecher needs to start into one string:
+// bt://<fileid>?name=..&size=..&hash=..&peer=<multiaddr>
+package p2p
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/srivatsa-bot/bt-p2p/files"
+)
+
+const LinkScheme = "bt"
+
+// ShareLink is a parsed bt:// link. everything but the file id is optional
+type ShareLink struct {
+	FileID string
+	Name   string
+	Size   int64
+	Hash   string          // full file sha256 in hex
+	Peers  []peer.AddrInfo // seeders to dial before the DHT lookup finishes
+}
+
+// NewShareLink builds the link for a file this host serves, with the host's own addresses as peer hints
+func NewShareLink(h host.Host, m *files.Manifest) *ShareLink {
+	return &ShareLink{
+		FileID: m.FileID(),
+		Name:   m.Name,
+		Size:   m.Size,
+		Hash:   m.FileHash,
+		Peers:  []peer.AddrInfo{{ID: h.ID(), Addrs: h.Addrs()}},
+	}
+}
+
+// IsShareLink reports whether s looks like a bt:// link rather than a bare file id
+func IsShareLink(s string) bool {
+	return strings.HasPrefix(s, LinkScheme+"://")
+}
+
+func (l *ShareLink) String() string {
+	q := url.Values{}
+	if l.Name != "" {
+		q.Set("name", l.Name)
+	}
+	if l.Size > 0 {
+		q.Set("size", strconv.FormatInt(l.Size, 10))
+	}
+	if l.Hash != "" {
+		q.Set("hash", l.Hash)
+	}
+	query := q.Encode()
+
+	// multiaddrs are left unescaped so the link stays readable, slashes are fine in a query
+	for i := range l.Peers {
+		addrs, err := peer.AddrInfoToP2pAddrs(&l.Peers[i])
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if query != "" {
+				query += "&"
+			}
+			query += "peer=" + a.String()
+		}
+	}
+
+	u := url.URL{Scheme: LinkScheme, Host: l.FileID, RawQuery: query}
+	return u.String()
+}
+
+// ParseShareLink parses a bt:// link. peer addresses must end in /p2p/<peer id>
+func ParseShareLink(s string) (*ShareLink, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid share link: %w", err)
+	}
+	if u.Scheme != LinkScheme {
+		return nil, fmt.Errorf("invalid share link: scheme is %q, expected %q", u.Scheme, LinkScheme)
+	}
+	if u.Host == "" || (u.Path != "" && u.Path != "/") {
+		return nil, fmt.Errorf("invalid share link: missing or malformed file id")
+	}
+
+	id, err := files.ParseFileID(u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid share link: %w", err)
+	}
+
+	q := u.Query()
+	l := &ShareLink{FileID: id.String(), Name: q.Get("name"), Hash: strings.ToLower(q.Get("hash"))}
+
+	// the name becomes the default output path, it must not point anywhere else
+	if l.Name != "" && (l.Name != filepath.Base(l.Name) || l.Name == "." || l.Name == ".." || strings.ContainsAny(l.Name, `/\`)) {
+		return nil, fmt.Errorf("invalid share link: bad name %q", l.Name)
+	}
+
+	if v := q.Get("size"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid share link: bad size %q", v)
+		}
+		l.Size = size
+	}
+
+	var addrs []ma.Multiaddr
+	for _, v := range q["peer"] {
+		a, err := ma.NewMultiaddr(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid share link: bad peer address %q: %w", v, err)
+		}
+		addrs = append(addrs, a)
+	}
+	if len(addrs) > 0 {
+		l.Peers, err = peer.AddrInfosFromP2pAddrs(addrs...)
+		if err != nil {
+			return nil, fmt.Errorf("invalid share link: peer address without /p2p/ part: %w", err)
+		}
+	}
+	return l, nil
+}
+
+// Check makes sure a fetched manifest is the content the link describes
+func (l *ShareLink) Check(m *files.Manifest) error {
+	if m.FileID() != l.FileID {
+		return fmt.Errorf("manifest is for file %s, link is for %s", m.FileID(), l.FileID)
+	}
+	// the file id only covers the data and its chunking, the name and hash come from the link
+	if l.Name != "" && m.Name != l.Name {
+		return fmt.Errorf("manifest name %q does not match link name %q", m.Name, l.Name)
+	}
+	if l.Size > 0 && m.Size != l.Size {
+		return fmt.Errorf("manifest size %d does not match link size %d", m.Size, l.Size)
+	}
+	if l.Hash != "" && m.FileHash != l.Hash {
+		return fmt.Errorf("manifest hash does not match link hash: %w", files.ErrHashMismatch)
+	}
+	return nil
+}
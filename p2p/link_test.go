@@ -0,0 +1,92 @@
+package p2p
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/srivatsa-bot/bt-p2p/files"
+)
+
+// a file id and peer address that parse, for links built by hand
+const (
+	testLinkID   = "bafkreigh2akiscaildcqabsyg3dfr6chu3fgpregiymsck7e7aqa4s52zy"
+	testLinkPeer = "/ip4/203.0.113.7/tcp/4001/p2p/QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN"
+)
+
+func TestShareLinkRoundTrip(t *testing.T) {
+	h := newTestHost(t)
+	path := filepath.Join(t.TempDir(), "data v1 (final).bin")
+	writeTestFile(t, path, 3*files.ChunkSize+5)
+	m, err := files.BuildManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	link := NewShareLink(h, m)
+	s := link.String()
+	if !IsShareLink(s) {
+		t.Fatalf("%s is not taken for a share link", s)
+	}
+	got, err := ParseShareLink(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.FileID != m.FileID() || got.Name != m.Name || got.Size != m.Size || got.Hash != m.FileHash {
+		t.Fatalf("parsed %+v from %s", got, s)
+	}
+	if len(got.Peers) != 1 || got.Peers[0].ID != h.ID() || len(got.Peers[0].Addrs) != len(h.Addrs()) {
+		t.Fatalf("parsed peers %v, want %s with %v", got.Peers, h.ID(), h.Addrs())
+	}
+	if err := got.Check(m); err != nil {
+		t.Fatalf("link does not match its own manifest: %v", err)
+	}
+
+	// the link pins what the file id does not cover
+	other := partialManifest(t, m)
+	other.Name = "other.bin"
+	if err := got.Check(other); err == nil {
+		t.Fatal("manifest with another name matched the link")
+	}
+}
+
+func TestParseShareLink(t *testing.T) {
+	tests := []struct {
+		name  string
+		link  string
+		ok    bool
+		peers int
+	}{
+		{"bare id", "bt://" + testLinkID, true, 0},
+		{"all fields", "bt://" + testLinkID + "?name=a.bin&size=10&hash=AB&peer=" + testLinkPeer, true, 1},
+		{"peer twice", "bt://" + testLinkID + "?peer=" + testLinkPeer + "&peer=" + strings.Replace(testLinkPeer, "tcp/4001", "udp/4001/quic-v1", 1), true, 1},
+		{"other scheme", "http://" + testLinkID, false, 0},
+		{"no id", "bt://?name=a.bin", false, 0},
+		{"bad id", "bt://notacid", false, 0},
+		{"path after id", "bt://" + testLinkID + "/x", false, 0},
+		{"name with slash", "bt://" + testLinkID + "?name=a%2Fb", false, 0},
+		{"name with backslash", "bt://" + testLinkID + "?name=a%5Cb", false, 0},
+		{"dot dot name", "bt://" + testLinkID + "?name=..", false, 0},
+		{"negative size", "bt://" + testLinkID + "?size=-1", false, 0},
+		{"bad size", "bt://" + testLinkID + "?size=ten", false, 0},
+		{"peer not a multiaddr", "bt://" + testLinkID + "?peer=203.0.113.7:4001", false, 0},
+		{"peer without p2p", "bt://" + testLinkID + "?peer=/ip4/203.0.113.7/tcp/4001", false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := ParseShareLink(tt.link)
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("%s was accepted", tt.link)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if l.FileID != testLinkID || len(l.Peers) != tt.peers {
+				t.Fatalf("parsed %+v", l)
+			}
+		})
+	}
+}
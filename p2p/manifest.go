@@ -0,0 +1,193 @@
+// manifest exchange, leecher asks a provider for the signed manifest of a file id before downloading chunks
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/srivatsa-bot/bt-p2p/files"
+)
+
+const ManifestProtocolID = protocol.ID("/bt/manifest/1.0.0")
+
+// upper bound on manifest size so a peer cant make us read forever
+const maxManifestSize = 32 * 1024 * 1024
+
+// SignedManifest is the manifest json plus the seeders public key and signature over that json
+type SignedManifest struct {
+	Manifest  []byte `json:"manifest"`
+	PublicKey []byte `json:"public_key"`
+	Signature []byte `json:"signature"`
+}
+
+// Signs the manifest with the hosts private key
+func SignManifest(h host.Host, m *files.Manifest) (*SignedManifest, error) {
+	priv := h.Peerstore().PrivKey(h.ID())
+	if priv == nil {
+		return nil, fmt.Errorf("no private key for host %s", h.ID())
+	}
+
+	data, err := m.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode manifest: %w", err)
+	}
+
+	sig, err := priv.Sign(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign manifest: %w", err)
+	}
+
+	pub, err := crypto.MarshalPublicKey(priv.GetPublic())
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode public key: %w", err)
+	}
+
+	return &SignedManifest{Manifest: data, PublicKey: pub, Signature: sig}, nil
+}
+
+// Verifies the signature was made by signer and returns the decoded manifest
+func (sm *SignedManifest) Open(signer peer.ID) (*files.Manifest, error) {
+	pub, err := crypto.UnmarshalPublicKey(sm.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+
+	// the key must belong to the peer we got the manifest from
+	id, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive peer id: %w", err)
+	}
+	if id != signer {
+		return nil, fmt.Errorf("manifest signed by %s, expected %s", id, signer)
+	}
+
+	ok, err := pub.Verify(sm.Manifest, sm.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify signature: %w", err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("invalid manifest signature")
+	}
+
+	m, err := files.UnmarshalManifest(sm.Manifest)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	return m, nil
+}
+
+// Runs on seeder side, answers manifest requests for every file in the registry
+func HandleManifestRequest(h host.Host, reg *Registry) error {
+	h.SetStreamHandler(ManifestProtocolID, func(s network.Stream) {
+		if !reg.permits(s) {
+			return
+		}
+		defer s.Close()
+
+		s.SetReadDeadline(time.Now().Add(30 * time.Second))
+
+		reader := bufio.NewReader(s)
+		req, err := reader.ReadString('\n') //leecher sends the file id it wants
+		if err != nil {
+			log.Printf("Failed to read manifest request: %v", err)
+			return
+		}
+		req = strings.TrimSpace(req)
+
+		file, ok := reg.Get(req)
+		if !ok {
+			log.Printf("Manifest requested for unknown file: %s", req)
+			return
+		}
+
+		s.SetWriteDeadline(time.Now().Add(30 * time.Second))
+		if _, err := s.Write(file.signed); err != nil {
+			log.Printf("Write error: %v", err)
+			return
+		}
+
+		log.Printf("%s %s", color.BlueString("Sent manifest to:"), s.Conn().RemotePeer())
+	})
+
+	return nil
+}
+
+// Runs on leecher side, asks each provider for the manifest until one returns a valid one
+func FetchManifest(ctx context.Context, h host.Host, peers []peer.AddrInfo, fileID string) (*files.Manifest, error) {
+	for _, pi := range peers {
+		m, err := requestManifest(ctx, h, pi, fileID)
+		if err != nil {
+			log.Printf("Failed to get manifest from peer %s: %v", pi.ID, err)
+			continue
+		}
+		log.Printf("%s %s", color.GreenString("Got manifest from peer"), pi.ID)
+		return m, nil
+	}
+	return nil, fmt.Errorf("no provider returned a valid manifest for file %s", fileID)
+}
+
+func requestManifest(ctx context.Context, h host.Host, pi peer.AddrInfo, fileID string) (*files.Manifest, error) {
+	connectCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	if err := h.Connect(connectCtx, pi); err != nil {
+		return nil, fmt.Errorf("failed to connect to peer %s: %w", pi.ID, err)
+	}
+
+	streamCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	s, err := h.NewStream(streamCtx, pi.ID, ManifestProtocolID)
+	if err != nil {
+		return nil, fmt.Errorf("stream creation failed: %w", err)
+	}
+	defer s.Close()
+
+	s.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	s.SetReadDeadline(time.Now().Add(30 * time.Second))
+
+	if _, err := fmt.Fprintf(s, "%s\n", fileID); err != nil {
+		return nil, fmt.Errorf("failed to send manifest request: %w", err)
+	}
+	s.CloseWrite()
+
+	data, err := io.ReadAll(io.LimitReader(s, maxManifestSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("peer does not have file %s", fileID)
+	}
+
+	var sm SignedManifest
+	if err := json.Unmarshal(data, &sm); err != nil {
+		return nil, fmt.Errorf("failed to decode signed manifest: %w", err)
+	}
+
+	m, err := sm.Open(pi.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// the file id is made from the merkle root and the chunking, so the manifest must match it.
+	// the name and file list are only vouched for by the provider's signature
+	if m.FileID() != fileID {
+		return nil, fmt.Errorf("manifest tree %s does not match file id %s", m.FileID(), fileID)
+	}
+	return m, nil
+}
@@ -0,0 +1,128 @@
+// this file finds peers on the local network with mDNS, so machines on one LAN can share files
+// without bootstrap nodes or a working DHT
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
+	"github.com/srivatsa-bot/bt-p2p/files"
+)
+
+// mDNS service bt nodes announce, other libp2p apps on the LAN use their own
+const MDNSServiceName = "_bt._udp"
+
+// LocalPeers runs mDNS discovery and keeps the peers found on the local network.
+// Every peer found is connected, so the DHT adds it to its routing table as well
+type LocalPeers struct {
+	h   host.Host
+	svc mdns.Service
+
+	mu       sync.Mutex // Protect peers and watchers
+	peers    map[peer.ID]peer.AddrInfo
+	watchers map[int]func(peer.AddrInfo)
+	nextID   int
+}
+
+// Starts announcing this host on the local network and looking for other bt nodes until ctx ends
+func StartLocalDiscovery(ctx context.Context, h host.Host) (*LocalPeers, error) {
+	lp := &LocalPeers{
+		h:        h,
+		peers:    make(map[peer.ID]peer.AddrInfo),
+		watchers: make(map[int]func(peer.AddrInfo)),
+	}
+	lp.svc = mdns.NewMdnsService(h, MDNSServiceName, lp)
+	if err := lp.svc.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start mdns: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		lp.svc.Close()
+	}()
+	return lp, nil
+}
+
+// HandlePeerFound is called by mdns every time a peer answers, watchers hear about peers that are new
+// or were not connected anymore
+func (lp *LocalPeers) HandlePeerFound(pi peer.AddrInfo) {
+	wasConnected := lp.h.Network().Connectedness(pi.ID) == network.Connected
+
+	connectCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := lp.h.Connect(connectCtx, pi); err != nil {
+		log.Printf("Failed to connect to local peer %s: %v", pi.ID, err)
+		return
+	}
+
+	lp.mu.Lock()
+	_, known := lp.peers[pi.ID]
+	lp.peers[pi.ID] = pi
+	watchers := make([]func(peer.AddrInfo), 0, len(lp.watchers))
+	for _, fn := range lp.watchers {
+		watchers = append(watchers, fn)
+	}
+	lp.mu.Unlock()
+
+	if known && wasConnected {
+		return
+	}
+	if !known {
+		log.Printf("%s %s", color.GreenString("Found local peer:"), pi.ID)
+	}
+	for _, fn := range watchers {
+		fn(pi)
+	}
+}
+
+// Peers returns the local peers found so far
+func (lp *LocalPeers) Peers() []peer.AddrInfo {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	peers := make([]peer.AddrInfo, 0, len(lp.peers))
+	for _, pi := range lp.peers {
+		peers = append(peers, pi)
+	}
+	return peers
+}
+
+// Watch calls fn for every local peer, the ones already found and each one found later, until ctx ends.
+// fn runs on the mdns goroutines and can be called concurrently
+func (lp *LocalPeers) Watch(ctx context.Context, fn func(peer.AddrInfo)) {
+	lp.mu.Lock()
+	id := lp.nextID
+	lp.nextID++
+	lp.watchers[id] = fn
+	lp.mu.Unlock()
+
+	for _, pi := range lp.Peers() {
+		go fn(pi)
+	}
+
+	go func() {
+		<-ctx.Done()
+		lp.mu.Lock()
+		delete(lp.watchers, id)
+		lp.mu.Unlock()
+	}()
+}
+
+// WatchLocalProviders asks every local peer, found now or later, for the manifest of the file and calls found
+// for each one that has it until ctx ends. on a LAN without bootstrap nodes these are the only providers
+func WatchLocalProviders(ctx context.Context, h host.Host, lp *LocalPeers, fileID string, found func(peer.AddrInfo, *files.Manifest)) {
+	lp.Watch(ctx, func(pi peer.AddrInfo) {
+		m, err := requestManifest(ctx, h, pi, fileID)
+		if err != nil {
+			return // most local peers simply dont have the file
+		}
+		log.Printf("%s %s", color.BlueString("Local peer has the file:"), pi.ID)
+		found(pi, m)
+	})
+}
@@ -0,0 +1,280 @@
+// chooses which chunk to fetch next, rarest first, based on the bitfields peers advertise
+package p2p
+
+import (
+	"context"
+	"math"
+	"math/rand/v2"
+	"sort"
+	"sync"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/srivatsa-bot/bt-p2p/files"
+)
+
+// chunk states inside the picker
+const (
+	chunkPending  = iota // still needed, nobody is fetching it
+	chunkInFlight        // a worker is fetching it
+	chunkDone            // written and verified, or given up on
+)
+
+// once this few chunks are left, chunks already in flight are also requested from other peers
+const endgameThreshold = 16
+
+// most requests running at once for one chunk in endgame
+const endgameMaxRequests = 3
+
+// piecePicker hands out chunks so the ones held by fewest peers go first.
+// That way partial seeders are useful and rare chunks are copied before their only holder leaves.
+// Near the end it switches to endgame and hands out in flight chunks again so a slow peer cant stall the tail
+type piecePicker struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	state    []uint8
+	requests []int  // requests running for each chunk
+	noDup    []bool // no spare peer for another request on this chunk
+	avail    []int  // how many peers have each chunk
+	peerHave map[peer.ID]files.Bitfield
+	order    []int // chunk ids sorted rarest first, rebuilt when availability changes
+	start    int   // everything in order before start is done
+	dirty    bool
+	left     int // chunks not done yet
+}
+
+func newPiecePicker(total int, done files.Bitfield) *piecePicker {
+	pp := &piecePicker{
+		state:    make([]uint8, total),
+		requests: make([]int, total),
+		noDup:    make([]bool, total),
+		avail:    make([]int, total),
+		peerHave: make(map[peer.ID]files.Bitfield),
+		dirty:    true,
+	}
+	pp.cond = sync.NewCond(&pp.mu)
+	for i := range pp.state {
+		if done.Has(i) {
+			pp.state[i] = chunkDone
+		} else {
+			pp.left++
+		}
+	}
+	return pp
+}
+
+// setPeerHave replaces what a peer is known to have
+func (pp *piecePicker) setPeerHave(id peer.ID, have files.Bitfield) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	pp.setPeerHaveLocked(id, have)
+}
+
+// assumeFull records a peer that could not tell us what it has as having everything,
+// unless it told us before. then its last bitfield is kept
+func (pp *piecePicker) assumeFull(id peer.ID) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if _, ok := pp.peerHave[id]; !ok {
+		pp.setPeerHaveLocked(id, fullBitfield(len(pp.state)))
+	}
+}
+
+// called with pp.mu held
+func (pp *piecePicker) setPeerHaveLocked(id peer.ID, have files.Bitfield) {
+	old := pp.peerHave[id]
+	for i := range pp.avail {
+		if old.Has(i) {
+			pp.avail[i]--
+		}
+		if have.Has(i) {
+			pp.avail[i]++
+		}
+	}
+	pp.peerHave[id] = have
+	pp.dirty = true
+	pp.cond.Broadcast()
+}
+
+// removePeer forgets a peer, its chunks no longer count towards availability
+func (pp *piecePicker) removePeer(id peer.ID) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	old, ok := pp.peerHave[id]
+	if !ok {
+		return
+	}
+	for i := range pp.avail {
+		if old.Has(i) {
+			pp.avail[i]--
+		}
+	}
+	delete(pp.peerHave, id)
+	pp.dirty = true
+	pp.cond.Broadcast()
+}
+
+// hasChunk reports whether a peer advertised a chunk, peers we know nothing about are assumed to have it
+func (pp *piecePicker) hasChunk(id peer.ID, chunkID int) bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	have, ok := pp.peerHave[id]
+	return !ok || have.Has(chunkID)
+}
+
+// next blocks until there is a chunk to fetch and marks it in flight. dup is set when the chunk
+// is already being fetched and this is an extra endgame request for it.
+// returns false when everything is done, when ctx ends, or when no peer has any of the remaining chunks
+func (pp *piecePicker) next(ctx context.Context) (chunkID int, dup bool, ok bool) {
+	stop := context.AfterFunc(ctx, func() {
+		pp.mu.Lock()
+		pp.cond.Broadcast()
+		pp.mu.Unlock()
+	})
+	defer stop()
+
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	for {
+		if ctx.Err() != nil || pp.left == 0 {
+			return 0, false, false
+		}
+
+		if pp.dirty {
+			pp.rebuildOrder()
+		}
+
+		// picks come from the front so finished chunks pile up there, skip past them once
+		for pp.start < len(pp.order) && pp.state[pp.order[pp.start]] == chunkDone {
+			pp.start++
+		}
+
+		dupID, inFlight := -1, false
+		for _, id := range pp.order[pp.start:] {
+			switch pp.state[id] {
+			case chunkPending:
+				if pp.avail[id] > 0 {
+					pp.state[id] = chunkInFlight
+					pp.requests[id]++
+					return id, false, true
+				}
+			case chunkInFlight:
+				inFlight = true
+				// endgame: least requested in flight chunk that another peer could still serve
+				if pp.left <= endgameThreshold && !pp.noDup[id] &&
+					pp.requests[id] < min(endgameMaxRequests, pp.avail[id]) &&
+					(dupID < 0 || pp.requests[id] < pp.requests[dupID]) {
+					dupID = id
+				}
+			}
+		}
+
+		if dupID >= 0 {
+			pp.requests[dupID]++
+			return dupID, true, true
+		}
+
+		// nothing to hand out right now. if other chunks are in flight they may fail and come back
+		if !inFlight {
+			return 0, false, false
+		}
+		pp.cond.Wait()
+	}
+}
+
+// done marks a chunk finished, either verified or given up on
+func (pp *piecePicker) done(chunkID int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if pp.requests[chunkID] > 0 {
+		pp.requests[chunkID]--
+	}
+	if pp.state[chunkID] != chunkDone {
+		pp.state[chunkID] = chunkDone
+		pp.left--
+	}
+	pp.cond.Broadcast()
+}
+
+// release ends a request that did not finish the chunk. once no request is left
+// the chunk goes back to pending so another worker can pick it up
+func (pp *piecePicker) release(chunkID int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if pp.requests[chunkID] > 0 {
+		pp.requests[chunkID]--
+	}
+	if pp.requests[chunkID] == 0 && pp.state[chunkID] == chunkInFlight {
+		pp.state[chunkID] = chunkPending
+		pp.noDup[chunkID] = false
+	}
+	pp.cond.Broadcast()
+}
+
+// stopDuplicates stops endgame requests for a chunk, every peer that has it is already busy with it
+func (pp *piecePicker) stopDuplicates(chunkID int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	pp.noDup[chunkID] = true
+}
+
+// reopen puts given up chunks back in play, used when a new peer may have them
+func (pp *piecePicker) reopen(ids []int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	for _, id := range ids {
+		if pp.state[id] == chunkDone {
+			pp.state[id] = chunkPending
+			pp.left++
+		}
+	}
+	pp.dirty = true
+	pp.cond.Broadcast()
+}
+
+// remaining lists chunks that are not done, used to report what could not be fetched
+func (pp *piecePicker) remaining() []int {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	var ids []int
+	for id, st := range pp.state {
+		if st != chunkDone {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// sorts the chunks that are not done by availability, ties are shuffled so
+// leechers dont all go after the same chunk. chunks nobody has go last. called with pp.mu held
+func (pp *piecePicker) rebuildOrder() {
+	pp.order = pp.order[:0]
+	for id, st := range pp.state {
+		if st != chunkDone {
+			pp.order = append(pp.order, id)
+		}
+	}
+	rand.Shuffle(len(pp.order), func(i, j int) { pp.order[i], pp.order[j] = pp.order[j], pp.order[i] })
+	sort.SliceStable(pp.order, func(i, j int) bool {
+		return rarity(pp.avail[pp.order[i]]) < rarity(pp.avail[pp.order[j]])
+	})
+	pp.start = 0
+	pp.dirty = false
+}
+
+// sort key for availability, chunks no peer has cant be picked so they sort after everything else
+func rarity(avail int) int {
+	if avail == 0 {
+		return math.MaxInt
+	}
+	return avail
+}
+
+func fullBitfield(n int) files.Bitfield {
+	b := files.NewBitfield(n)
+	for i := 0; i < n; i++ {
+		b.Set(i)
+	}
+	return b
+}
@@ -0,0 +1,153 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/srivatsa-bot/bt-p2p/files"
+)
+
+func testBitfield(n int, have ...int) files.Bitfield {
+	b := files.NewBitfield(n)
+	for _, i := range have {
+		b.Set(i)
+	}
+	return b
+}
+
+// next with a short timeout, so a picker that would block fails the test instead
+func pickNext(t *testing.T, pp *piecePicker) (int, bool, bool) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return pp.next(ctx)
+}
+
+func TestPickerRarestFirst(t *testing.T) {
+	tests := []struct {
+		name  string
+		total int
+		done  []int
+		peers [][]int // chunks each peer has
+		order [][]int // chunks expected from each call to next, any order within a group
+	}{
+		{"rarest first", 4, nil, [][]int{{0, 1, 2, 3}, {0, 1, 2}, {0, 1}}, [][]int{{3}, {2}, {0, 1}, {0, 1}}},
+		{"done chunks skipped", 4, []int{3}, [][]int{{0, 1, 2, 3}, {0, 1, 2}, {0, 1}}, [][]int{{2}, {0, 1}, {0, 1}}},
+		{"chunks nobody has left out", 3, nil, [][]int{{0}, {0, 2}}, [][]int{{2}, {0}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pp := newPiecePicker(tt.total, testBitfield(tt.total, tt.done...))
+			for i, have := range tt.peers {
+				pp.setPeerHave(peer.ID(rune('a'+i)), testBitfield(tt.total, have...))
+			}
+			for _, want := range tt.order {
+				id, dup, ok := pickNext(t, pp)
+				if !ok || dup {
+					t.Fatalf("next gave %d dup=%v ok=%v, want one of %v", id, dup, ok, want)
+				}
+				found := false
+				for _, w := range want {
+					found = found || id == w
+				}
+				if !found {
+					t.Fatalf("next gave chunk %d, want one of %v", id, want)
+				}
+				pp.done(id)
+			}
+			if id, _, ok := pickNext(t, pp); ok {
+				t.Fatalf("next gave chunk %d after everything available was done", id)
+			}
+		})
+	}
+}
+
+func TestPickerEndgame(t *testing.T) {
+	tests := []struct {
+		name  string
+		total int
+		peers int
+		dups  int // extra requests handed out once every chunk is in flight
+	}{
+		{"one peer gets no duplicates", 2, 1, 0},
+		{"duplicates up to the peers that have the chunk", 2, 2, 2},
+		{"at most endgameMaxRequests per chunk", 1, 5, endgameMaxRequests - 1},
+		{"no duplicates before the endgame", endgameThreshold + 1, 3, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pp := newPiecePicker(tt.total, files.NewBitfield(tt.total))
+			for i := 0; i < tt.peers; i++ {
+				pp.setPeerHave(peer.ID(rune('a'+i)), fullBitfield(tt.total))
+			}
+			for i := 0; i < tt.total; i++ {
+				if _, dup, ok := pickNext(t, pp); !ok || dup {
+					t.Fatalf("pick %d: dup=%v ok=%v", i, dup, ok)
+				}
+			}
+
+			// outside the endgame or without spare peers next waits for the running requests
+			dups := 0
+			for {
+				ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+				id, dup, ok := pp.next(ctx)
+				cancel()
+				if !ok {
+					break
+				}
+				if !dup {
+					t.Fatalf("chunk %d handed out again as a new request", id)
+				}
+				dups++
+			}
+			if dups != tt.dups {
+				t.Fatalf("%d duplicate requests, want %d", dups, tt.dups)
+			}
+		})
+	}
+}
+
+func TestPickerStopDuplicates(t *testing.T) {
+	pp := newPiecePicker(1, files.NewBitfield(1))
+	pp.setPeerHave("a", fullBitfield(1))
+	pp.setPeerHave("b", fullBitfield(1))
+	if _, _, ok := pickNext(t, pp); !ok {
+		t.Fatal("nothing to pick")
+	}
+	pp.stopDuplicates(0)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, ok := pp.next(ctx); ok {
+		t.Fatal("duplicate handed out after stopDuplicates")
+	}
+
+	// once the request fails the chunk is a normal pick again
+	pp.release(0)
+	if id, dup, ok := pickNext(t, pp); !ok || dup || id != 0 {
+		t.Fatalf("next gave %d dup=%v ok=%v after release", id, dup, ok)
+	}
+}
+
+func TestPickerAssumeFull(t *testing.T) {
+	pp := newPiecePicker(3, files.NewBitfield(3))
+
+	// a peer that never told us anything is taken to have every chunk
+	pp.assumeFull("a")
+	for i := 0; i < 3; i++ {
+		if !pp.hasChunk("a", i) {
+			t.Fatalf("peer without a bitfield lacks chunk %d", i)
+		}
+	}
+
+	// once it did, a failed refresh keeps what it said
+	pp.setPeerHave("b", testBitfield(3, 1))
+	pp.assumeFull("b")
+	if pp.hasChunk("b", 0) || !pp.hasChunk("b", 1) {
+		t.Fatal("failed refresh replaced the last known bitfield")
+	}
+	if pp.avail[0] != 1 || pp.avail[1] != 2 {
+		t.Fatalf("availability %v, want [1 2 1]", pp.avail)
+	}
+}
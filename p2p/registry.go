@@ -0,0 +1,202 @@
+// registry of files served by this node, one host can seed many files at once
+package p2p
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/fatih/color"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/srivatsa-bot/bt-p2p/files"
+)
+
+// returned by Remove for a file a download in progress is still writing, cancel the download instead
+var ErrDownloading = errors.New("file is still being downloaded")
+
+// SharedFile is one file or directory this node serves
+type SharedFile struct {
+	ID       string
+	Path     string
+	Manifest *files.Manifest
+	content  files.Source   // the seeded files, the download in progress or the chunk store
+	signed   []byte         // signed manifest json, sent as is to leechers
+	mu       sync.RWMutex   // guards have and partial, a download in progress keeps adding chunks
+	have     files.Bitfield // chunks this node can serve
+	partial  bool           // content belongs to a download in progress, it can not be removed or closed here
+}
+
+// Creates a shared file from already opened content and its signed manifest
+func NewSharedFile(path string, m *files.Manifest, content files.Source, sm *SignedManifest) (*SharedFile, error) {
+	if content.Size() != m.Size {
+		return nil, fmt.Errorf("content size %d does not match manifest size %d", content.Size(), m.Size)
+	}
+	signed, err := json.Marshal(sm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode signed manifest: %w", err)
+	}
+	return &SharedFile{
+		ID:       m.FileID(),
+		Path:     path,
+		Manifest: m,
+		content:  content,
+		signed:   signed,
+		have:     fullBitfield(m.ChunkCount()),
+	}, nil
+}
+
+// Chunks this node can serve, sent to leechers so they can pick rarest first
+func (f *SharedFile) Bitfield() files.Bitfield {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return append(files.Bitfield(nil), f.have...)
+}
+
+// Has reports whether a chunk can be served
+func (f *SharedFile) Has(chunkID int) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.have.Has(chunkID)
+}
+
+// Complete reports whether every chunk can be served
+func (f *SharedFile) Complete() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.have.Count() == f.Manifest.ChunkCount()
+}
+
+func (f *SharedFile) isPartial() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.partial
+}
+
+// marks a verified chunk as servable, returns true if it is the first one
+func (f *SharedFile) markHave(chunkID int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	first := f.have.Count() == 0
+	f.have.Set(chunkID)
+	return first && f.have.Has(chunkID)
+}
+
+// Reads one chunk from the content, chunk may span several files for a directory
+func (f *SharedFile) ReadChunk(chunkID int) ([]byte, error) {
+	if chunkID < 0 || chunkID >= f.Manifest.ChunkCount() {
+		return nil, fmt.Errorf("chunk %d: %w", chunkID, ErrOutOfRange)
+	}
+	if !f.Has(chunkID) {
+		return nil, fmt.Errorf("chunk %d: %w", chunkID, ErrNotHave)
+	}
+	offset, length := f.Manifest.ChunkRange(chunkID)
+	buf := make([]byte, length)
+	if _, err := f.content.ReadAt(buf, offset); err != nil {
+		return nil, fmt.Errorf("failed to read chunk %d: %w", chunkID, err)
+	}
+	return buf, nil
+}
+
+// Registry tracks every file this node is serving, keyed by file id.
+// Files can be added and removed while the stream handlers are running
+type Registry struct {
+	mu    sync.RWMutex
+	files map[string]*SharedFile
+	acl   *ACL // peers the handlers refuse, nil serves everyone
+}
+
+func NewRegistry() *Registry {
+	return &Registry{files: make(map[string]*SharedFile)}
+}
+
+func (r *Registry) Add(f *SharedFile) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.files[f.ID]; ok {
+		return fmt.Errorf("file %s is already being served", f.ID)
+	}
+	r.files[f.ID] = f
+	return nil
+}
+
+// Stops serving a file and closes its content. A download in progress still writes to its content,
+// it is only removed by the download itself with removePartial
+func (r *Registry) Remove(id string) error {
+	r.mu.Lock()
+	f, ok := r.files[id]
+	if ok && f.isPartial() {
+		r.mu.Unlock()
+		return fmt.Errorf("file %s: %w", id, ErrDownloading)
+	}
+	delete(r.files, id)
+	r.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("file %s is not being served", id)
+	}
+	return f.content.Close()
+}
+
+// stops serving a download in progress, its content is left open for the download to close
+func (r *Registry) removePartial(f *SharedFile) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.files[f.ID] == f {
+		delete(r.files, f.ID)
+	}
+}
+
+// SetACL makes the handlers refuse streams from peers the acl does not let pull files
+func (r *Registry) SetACL(acl *ACL) {
+	r.mu.Lock()
+	r.acl = acl
+	r.mu.Unlock()
+}
+
+// reports whether the peer on the other end of s may be served, refused streams are reset
+func (r *Registry) permits(s network.Stream) bool {
+	r.mu.RLock()
+	acl := r.acl
+	r.mu.RUnlock()
+	if acl == nil || acl.AllowServe(s) {
+		return true
+	}
+	log.Printf("%s %s (%s)", color.RedString("Refused peer denied by acl:"), s.Conn().RemotePeer(), s.Protocol())
+	s.Reset()
+	return false
+}
+
+func (r *Registry) Get(id string) (*SharedFile, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	f, ok := r.files[id]
+	return f, ok
+}
+
+// Returns the only served file, used for old leechers that dont send a file id
+func (r *Registry) only() (*SharedFile, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.files) != 1 {
+		return nil, false
+	}
+	for _, f := range r.files {
+		return f, true
+	}
+	return nil, false
+}
+
+// All served files sorted by id
+func (r *Registry) List() []*SharedFile {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	list := make([]*SharedFile, 0, len(r.files))
+	for _, f := range r.files {
+		list = append(list, f)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
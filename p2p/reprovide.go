@@ -0,0 +1,117 @@
+// keeps provider records of seeded files alive, records expire after ~48h and routing tables change long before that
+package p2p
+
+import (
+	"context"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+)
+
+const (
+	DefaultReprovideInterval = 1 * time.Hour
+
+	reprovideJitter     = 0.1 // +-10% so many files dont all hit the dht at once
+	reprovideMinBackoff = 30 * time.Second
+	reprovideMaxBackoff = 30 * time.Minute
+)
+
+// Reprovider re-announces every seeded file on its own timer
+type Reprovider struct {
+	ctx      context.Context
+	kad      *dht.IpfsDHT
+	interval time.Duration
+	mu       sync.Mutex
+	loops    map[string]context.CancelFunc // one loop per file id
+}
+
+// Loops stop when ctx is cancelled
+func NewReprovider(ctx context.Context, kad *dht.IpfsDHT, interval time.Duration) *Reprovider {
+	if interval <= 0 {
+		interval = DefaultReprovideInterval
+	}
+	return &Reprovider{
+		ctx:      ctx,
+		kad:      kad,
+		interval: interval,
+		loops:    make(map[string]context.CancelFunc),
+	}
+}
+
+// Starts re-announcing a file, first run is one interval from now since the caller just announced it
+func (r *Reprovider) Add(fileID string) {
+	r.add(fileID, jitter(r.interval))
+}
+
+// AddUnannounced starts re-announcing a file whose first announce failed, it is retried with backoff
+// like a failed re-announce. a node that only has local peers keeps trying until the DHT is reachable
+func (r *Reprovider) AddUnannounced(fileID string) {
+	r.add(fileID, reprovideMinBackoff)
+}
+
+func (r *Reprovider) add(fileID string, wait time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.loops[fileID]; ok {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.ctx)
+	r.loops[fileID] = cancel
+	go r.loop(ctx, fileID, wait)
+}
+
+// Stops re-announcing a file
+func (r *Reprovider) Remove(fileID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cancel, ok := r.loops[fileID]; ok {
+		cancel()
+		delete(r.loops, fileID)
+	}
+}
+
+func (r *Reprovider) loop(ctx context.Context, fileID string, wait time.Duration) {
+	backoff := reprovideMinBackoff
+
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		c, err := provideFile(ctx, r.kad, fileID)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			// retry sooner than the normal interval, backing off so a broken network isnt hammered
+			wait = backoff
+			if wait > r.interval {
+				wait = r.interval
+			}
+			log.Printf("%s %s (CID: %s): %v, retrying in %v", color.RedString("Re-announce failed for"), fileID, c, err, wait)
+			if backoff *= 2; backoff > reprovideMaxBackoff {
+				backoff = reprovideMaxBackoff
+			}
+			continue
+		}
+
+		wait = jitter(r.interval)
+		backoff = reprovideMinBackoff
+		log.Printf("%s %s (CID: %s), next in %v", color.GreenString("Re-announced file"), fileID, c, wait.Round(time.Second))
+	}
+}
+
+// Spreads d by +-reprovideJitter
+func jitter(d time.Duration) time.Duration {
+	spread := float64(d) * reprovideJitter
+	return d + time.Duration((rand.Float64()*2-1)*spread)
+}
@@ -0,0 +1,261 @@
+// resume state for downloads, saved next to the output so an interrupted download only fetches whats missing
+package p2p
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/srivatsa-bot/bt-p2p/files"
+)
+
+const resumeSuffix = ".bt-resume"
+
+// merkle tree nodes of verified chunks, the leaf and proof of each at node index * 32 (see MerkleTree.PathIndexes).
+// the manifest does not list chunk hashes, so resumed chunks are checked against the root through these,
+// which also gives them back the proofs they are re-served with
+const treeSuffix = ".tree"
+
+// what gets written to the sidecar file
+type resumeState struct {
+	FileHash string         `json:"file_hash"`
+	Chunks   int            `json:"chunks"`
+	Have     files.Bitfield `json:"have"` // chunks that were verified and written
+}
+
+func resumePath(output string) string {
+	return output + resumeSuffix
+}
+
+func treePath(statePath string) string {
+	return statePath + treeSuffix
+}
+
+// Loads the sidecar and re-checks every chunk it lists against the data on disk and the merkle root,
+// the tree of m learns the proofs of the chunks that pass. A missing or stale sidecar just means starting from zero.
+func loadResumeState(path string, m *files.Manifest, out io.ReaderAt) (files.Bitfield, error) {
+	have := files.NewBitfield(m.ChunkCount())
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return have, nil
+	}
+	if err != nil {
+		return have, fmt.Errorf("failed to read resume state: %w", err)
+	}
+
+	var st resumeState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return have, fmt.Errorf("failed to decode resume state: %w", err)
+	}
+	if st.FileHash != m.FileHash || st.Chunks != m.ChunkCount() {
+		return have, fmt.Errorf("resume state belongs to a different file")
+	}
+
+	nodes, err := os.Open(treePath(path))
+	if err != nil {
+		return have, fmt.Errorf("failed to open resume merkle tree: %w", err)
+	}
+	defer nodes.Close()
+
+	// sidecar may have been flushed before the chunk data hit the disk, so dont trust it blindly.
+	// a node that never made it to disk reads as zero and fails the check against the root
+	tree := m.Tree()
+	buf := make([]byte, m.ChunkSize)
+	for i := 0; i < st.Chunks; i++ {
+		if !st.Have.Has(i) {
+			continue
+		}
+		leafAt, proofAt := tree.PathIndexes(i)
+		leaf, err := readNode(nodes, leafAt)
+		if err != nil {
+			continue
+		}
+		proof := make(files.MerkleProof, len(proofAt))
+		for level, at := range proofAt {
+			if proof[level], err = readNode(nodes, at); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			continue
+		}
+		off, length := m.ChunkRange(i)
+		if _, err := out.ReadAt(buf[:length], off); err != nil {
+			continue
+		}
+		if files.ChunkHash(buf[:length]) == leaf && tree.Verify(i, leaf, proof) == nil {
+			have.Set(i)
+		}
+	}
+	return have, nil
+}
+
+func readNode(f *os.File, index int) ([32]byte, error) {
+	var node [32]byte
+	_, err := f.ReadAt(node[:], int64(index)*int64(len(node)))
+	return node, err
+}
+
+// verified chunks are flushed to the sidecar every this many chunks or this often, whichever comes first
+const (
+	resumeFlushChunks   = 64
+	resumeFlushInterval = time.Second
+)
+
+// resumeWriter keeps the sidecar up to date without a disk sync per chunk. the nodes of a verified chunk go into
+// the tree file right away, the tree file is synced and the json rewritten in batches. a crash loses the chunks
+// since the last flush, they are just downloaded again
+type resumeWriter struct {
+	mu        sync.Mutex
+	path      string
+	manifest  *files.Manifest
+	nodes     *os.File       // tree file, open while chunks are coming in
+	saved     files.Bitfield // chunks whose nodes are in the tree file
+	pending   int            // chunks not flushed yet
+	lastFlush time.Time
+	cleared   bool // download is complete, nothing is written anymore
+}
+
+func newResumeWriter(path string, m *files.Manifest, have files.Bitfield) *resumeWriter {
+	return &resumeWriter{
+		path:      path,
+		manifest:  m,
+		saved:     slices.Clone(have),
+		lastFlush: time.Now(),
+	}
+}
+
+// add records the leaf and proof of a verified chunk, flushing when a batch is full
+func (w *resumeWriter) add(chunkID int) error {
+	tree := w.manifest.Tree()
+	leaf, ok := tree.Leaf(chunkID)
+	proof, hasProof := tree.Proof(chunkID)
+	if !ok || !hasProof {
+		return fmt.Errorf("chunk %d: %w", chunkID, files.ErrNoProof)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.cleared {
+		return nil
+	}
+	if w.nodes == nil {
+		f, err := os.OpenFile(treePath(w.path), os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open resume merkle tree: %w", err)
+		}
+		w.nodes = f
+	}
+	leafAt, proofAt := tree.PathIndexes(chunkID)
+	if err := writeNode(w.nodes, leafAt, leaf); err != nil {
+		return err
+	}
+	for level, at := range proofAt {
+		if err := writeNode(w.nodes, at, proof[level]); err != nil {
+			return err
+		}
+	}
+	w.saved.Set(chunkID)
+	w.pending++
+
+	if w.pending >= resumeFlushChunks || time.Since(w.lastFlush) >= resumeFlushInterval {
+		return w.flushLocked()
+	}
+	return nil
+}
+
+// the tree file has to be on disk before the json lists its chunks
+func (w *resumeWriter) flushLocked() error {
+	if w.pending == 0 || w.cleared {
+		return nil
+	}
+	if err := w.nodes.Sync(); err != nil {
+		return fmt.Errorf("failed to sync resume merkle tree: %w", err)
+	}
+	if err := saveResumeState(w.path, w.manifest, w.saved); err != nil {
+		return err
+	}
+	w.pending = 0
+	w.lastFlush = time.Now()
+	return nil
+}
+
+// close flushes what is left and closes the tree file, called whenever chunks stop coming in.
+// a later add opens it again
+func (w *resumeWriter) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.nodes == nil {
+		return nil
+	}
+	err := w.flushLocked()
+	if cerr := w.nodes.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("failed to close resume merkle tree: %w", cerr)
+	}
+	w.nodes = nil
+	return err
+}
+
+// clear removes the sidecar, chunks verified after this are not recorded
+func (w *resumeWriter) clear() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.cleared = true
+	if w.nodes != nil {
+		w.nodes.Close()
+		w.nodes = nil
+	}
+	if err := os.Remove(w.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove resume state: %w", err)
+	}
+	if err := os.Remove(treePath(w.path)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove resume merkle tree: %w", err)
+	}
+	return nil
+}
+
+func writeNode(f *os.File, index int, node [32]byte) error {
+	if _, err := f.WriteAt(node[:], int64(index)*int64(len(node))); err != nil {
+		return fmt.Errorf("failed to write resume merkle tree: %w", err)
+	}
+	return nil
+}
+
+// Writes the sidecar atomically, temp file then rename so a crash never leaves half a file
+func saveResumeState(path string, m *files.Manifest, have files.Bitfield) error {
+	data, err := json.Marshal(resumeState{
+		FileHash: m.FileHash,
+		Chunks:   m.ChunkCount(),
+		Have:     have,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode resume state: %w", err)
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create resume state: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write resume state: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync resume state: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close resume state: %w", err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace resume state: %w", err)
+	}
+	return nil
+}
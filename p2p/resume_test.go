@@ -0,0 +1,287 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/srivatsa-bot/bt-p2p/files"
+)
+
+// partialManifest decodes m again, the copy only knows the merkle root like a leecher's
+func partialManifest(t *testing.T, m *files.Manifest) *files.Manifest {
+	t.Helper()
+	data, err := m.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm, err := files.UnmarshalManifest(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pm
+}
+
+// resumeFixture is a complete download of a 6 chunk file with a resume state listing every chunk
+type resumeFixture struct {
+	m         *files.Manifest // manifest with the full tree
+	out       string
+	statePath string
+}
+
+func newResumeFixture(t *testing.T) resumeFixture {
+	t.Helper()
+	d := t.TempDir()
+	out := filepath.Join(d, "out.bin")
+	writeTestFile(t, out, 5*files.ChunkSize+3)
+	m, err := files.BuildManifest(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := resumeFixture{m: m, out: out, statePath: resumePath(out)}
+	w := newResumeWriter(f.statePath, m, files.NewBitfield(m.ChunkCount()))
+	for i := 0; i < m.ChunkCount(); i++ {
+		if err := w.add(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// load reads the resume state back into a manifest that only knows the root
+func (f resumeFixture) load(t *testing.T) (*files.Manifest, files.Bitfield, error) {
+	t.Helper()
+	pm := partialManifest(t, f.m)
+	c, err := files.OpenContent(f.out, pm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	have, err := loadResumeState(f.statePath, pm, c)
+	return pm, have, err
+}
+
+func TestLoadResumeState(t *testing.T) {
+	tests := []struct {
+		name    string
+		damage  func(t *testing.T, f resumeFixture)
+		missing []int // chunks that must not be resumed
+		err     bool
+	}{
+		{"intact", func(*testing.T, resumeFixture) {}, nil, false},
+		{"chunk data changed", func(t *testing.T, f resumeFixture) {
+			data, _ := os.ReadFile(f.out)
+			data[files.ChunkSize+10] ^= 0xff
+			os.WriteFile(f.out, data, 0644)
+		}, []int{1}, false},
+		// the leaf of chunk 2 is also in the proof of chunk 3
+		{"leaf never reached the disk", func(t *testing.T, f resumeFixture) {
+			leaf, _ := f.m.Tree().PathIndexes(2)
+			nodes, err := os.OpenFile(treePath(f.statePath), os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer nodes.Close()
+			nodes.WriteAt(make([]byte, 32), int64(leaf)*32)
+		}, []int{2, 3}, false},
+		{"tree file missing", func(t *testing.T, f resumeFixture) {
+			os.Remove(treePath(f.statePath))
+		}, nil, true},
+		{"output cut short", func(t *testing.T, f resumeFixture) {
+			os.Truncate(f.out, 4*files.ChunkSize+1)
+		}, []int{4, 5}, false},
+		{"state missing", func(t *testing.T, f resumeFixture) {
+			os.Remove(f.statePath)
+		}, []int{0, 1, 2, 3, 4, 5}, false},
+		{"state of another file", func(t *testing.T, f resumeFixture) {
+			other := partialManifest(t, f.m)
+			other.FileHash = "00"
+			saveResumeState(f.statePath, other, files.NewBitfield(f.m.ChunkCount()))
+		}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newResumeFixture(t)
+			tt.damage(t, f)
+
+			pm, have, err := f.load(t)
+			if tt.err {
+				if err == nil || have.Count() != 0 {
+					t.Fatalf("got %d chunks and err %v, want an error", have.Count(), err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := f.m.ChunkCount() - len(tt.missing); have.Count() != want {
+				t.Fatalf("resumed %d chunks, want %d", have.Count(), want)
+			}
+			for _, i := range tt.missing {
+				if have.Has(i) {
+					t.Errorf("chunk %d was resumed", i)
+				}
+			}
+			// resumed chunks get their proofs back so they can be served again
+			for i := 0; i < f.m.ChunkCount(); i++ {
+				if _, ok := pm.Tree().Proof(i); have.Has(i) && !ok {
+					t.Errorf("chunk %d was resumed without a proof", i)
+				}
+			}
+		})
+	}
+}
+
+func TestResumedChunksAreServed(t *testing.T) {
+	f := newResumeFixture(t)
+	data, _ := os.ReadFile(f.out)
+	data[2*files.ChunkSize] ^= 0xff
+	os.WriteFile(f.out, data, 0644)
+	pm, have, err := f.load(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg := NewRegistry()
+	sf := shareTestFile(t, newTestHost(t), reg, f.out, pm)
+	sf.have = have
+	for i := 0; i < pm.ChunkCount(); i++ {
+		resp := serveRequest(reg, wireRequest{Type: msgChunkRequest, FileID: pm.FileID(), Chunk: uint32(i)})
+		if i == 2 {
+			if resp.Status != StatusNotHave {
+				t.Fatalf("chunk that failed to resume: status %d, want %d", resp.Status, StatusNotHave)
+			}
+			continue
+		}
+		if resp.Status != StatusOK {
+			t.Fatalf("chunk %d: status %d (%s)", i, resp.Status, resp.Payload)
+		}
+		if err := f.m.VerifyChunk(i, resp.Payload, resp.Proof); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestResumeWriterBatches(t *testing.T) {
+	d := t.TempDir()
+	out := filepath.Join(d, "out.bin")
+	writeTestFile(t, out, 3*files.ChunkSize)
+	m, err := files.BuildManifest(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statePath := resumePath(out)
+
+	w := newResumeWriter(statePath, m, files.NewBitfield(m.ChunkCount()))
+	if err := w.add(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(statePath); !os.IsNotExist(err) {
+		t.Fatal("resume state was written before the batch was full")
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(statePath); err != nil {
+		t.Fatal("close did not flush the resume state:", err)
+	}
+
+	// once cleared nothing brings the files back
+	if err := w.clear(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.add(1); err != nil {
+		t.Fatal(err)
+	}
+	w.close()
+	for _, p := range []string{statePath, treePath(statePath)} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s exists after clear", p)
+		}
+	}
+}
+
+func TestDownloadResumes(t *testing.T) {
+	ctx := context.Background()
+	d := t.TempDir()
+	src := filepath.Join(d, "src.bin")
+	writeTestFile(t, src, 4*files.ChunkSize+7)
+	m, err := files.BuildManifest(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeder := newTestHost(t)
+	reg := NewRegistry()
+	shareTestFile(t, seeder, reg, src, m)
+	HandleFileRequest(seeder, reg)
+	peers := []peer.AddrInfo{{ID: seeder.ID(), Addrs: seeder.Addrs()}}
+
+	leecher := newTestHost(t)
+	out := filepath.Join(d, "out.bin")
+	download := func() *ChunkDownloader {
+		pm := partialManifest(t, m)
+		c, err := files.CreateContent(out, pm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return NewChunkDownloader(leecher, peers, c, pm)
+	}
+
+	if err := download().DownloadChunksParallel(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// a second run finds everything on disk and fetches nothing
+	cd := download()
+	if n := cd.Downloaded().Count(); n != m.ChunkCount() {
+		t.Fatalf("resumed %d of %d chunks", n, m.ChunkCount())
+	}
+	if err := cd.DownloadChunksParallel(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := cd.BytesDownloaded(); n != 0 {
+		t.Errorf("fetched %d bytes again", n)
+	}
+	if err := cd.VerifyFile(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cd.ClearResumeState(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(resumePath(out)); !os.IsNotExist(err) {
+		t.Error("resume state left after clear")
+	}
+}
+
+func TestPartialFileBelongsToDownload(t *testing.T) {
+	d := t.TempDir()
+	out := filepath.Join(d, "out.bin")
+	writeTestFile(t, out, 2*files.ChunkSize)
+	m, err := files.BuildManifest(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := NewRegistry()
+	sf := shareTestFile(t, newTestHost(t), reg, out, m)
+	sf.partial = true
+
+	if err := reg.Remove(sf.ID); !errors.Is(err, ErrDownloading) {
+		t.Fatalf("removed a file still being downloaded: %v", err)
+	}
+	reg.removePartial(sf)
+	if _, ok := reg.Get(sf.ID); ok {
+		t.Fatal("file is still served")
+	}
+	// the download goes on writing to its content
+	if _, err := sf.ReadChunk(1); err != nil {
+		t.Fatal("content was closed:", err)
+	}
+}
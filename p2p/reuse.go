@@ -0,0 +1,215 @@
+// copies chunks an older local copy of the content has in common with the download, so only what changed is fetched
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fatih/color"
+	"github.com/srivatsa-bot/bt-p2p/files"
+)
+
+// where a chunk sits in the old copy
+type oldChunk struct {
+	offset int64
+	length int
+}
+
+// ReuseFrom fills in chunks from an old version of the content before downloading. The old copy is chunked
+// the same way as the manifest, with content defined chunking an edit only moves the chunks around it.
+// The hashes of the new chunks come from merkle proofs sent by peers, so nothing is copied the root does not vouch for.
+// returns how many chunks were reused
+func (cd *ChunkDownloader) ReuseFrom(ctx context.Context, oldPath string) (int, error) {
+	if same, err := samePath(oldPath, cd.out.Path()); err != nil {
+		return 0, err
+	} else if same {
+		return 0, fmt.Errorf("old copy %s is the download output itself", oldPath)
+	}
+
+	old, err := files.BuildManifestLike(oldPath, cd.manifest)
+	if err != nil {
+		return 0, fmt.Errorf("failed to chunk old copy: %w", err)
+	}
+	content, err := files.OpenContent(oldPath, old)
+	if err != nil {
+		return 0, err
+	}
+	defer content.Close()
+
+	// chunk hash -> place in the old copy, and the chunk sizes seen so only chunks that could match are looked up
+	index := make(map[[32]byte]oldChunk, old.ChunkCount())
+	sizes := make(map[int]bool)
+	for i := 0; i < old.ChunkCount(); i++ {
+		leaf, _ := old.Tree().Leaf(i)
+		off, length := old.ChunkRange(i)
+		index[leaf] = oldChunk{offset: off, length: length}
+		sizes[length] = true
+	}
+
+	// chunks of the new content that could be in the old copy, their hashes are fetched a range at a time
+	var candidates []int
+	for i := 0; i < cd.totalChunks; i++ {
+		if _, length := cd.manifest.ChunkRange(i); !cd.isDownloaded(i) && sizes[length] {
+			candidates = append(candidates, i)
+		}
+	}
+	cd.fetchHashes(ctx, candidates)
+
+	var reused atomic.Int64
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, max(1, cd.workerLimit()))
+	for _, i := range candidates {
+		if ctx.Err() != nil {
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(chunkID int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if cd.reuseChunk(ctx, chunkID, content, index) {
+				reused.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	cd.flushResumeState()
+
+	if n := reused.Load(); n > 0 {
+		log.Printf("%s %d/%d chunks from %s", color.GreenString("Reused:"), n, cd.totalChunks, oldPath)
+	}
+	return int(reused.Load()), ctx.Err()
+}
+
+// reuseChunk copies one chunk from the old copy if its hash is in there, false when it has to be downloaded
+func (cd *ChunkDownloader) reuseChunk(ctx context.Context, chunkID int, content *files.Content, index map[[32]byte]oldChunk) bool {
+	leaf, ok := cd.chunkLeaf(ctx, chunkID)
+	if !ok {
+		return false
+	}
+	src, ok := index[leaf]
+	if !ok {
+		return false
+	}
+
+	data := make([]byte, src.length)
+	if _, err := content.ReadAt(data, src.offset); err != nil {
+		log.Printf("Failed to read chunk from old copy: %v", err)
+		return false
+	}
+	// the leaf is known now, so this checks the data without a proof
+	if err := cd.manifest.VerifyChunk(chunkID, data, nil); err != nil {
+		return false
+	}
+
+	cd.chunkLocks[chunkID].Lock()
+	defer cd.chunkLocks[chunkID].Unlock()
+	if cd.isDownloaded(chunkID) {
+		return false
+	}
+	offset, _ := cd.manifest.ChunkRange(chunkID)
+	if _, err := cd.out.WriteAt(data, offset); err != nil {
+		log.Printf("Failed to write reused chunk %d: %v", chunkID, err)
+		return false
+	}
+	cd.markDownloaded(chunkID)
+	return true
+}
+
+// chunks whose hashes come in one request while reusing, 128KB of hashes
+const reuseHashRange = 4096
+
+// fetchHashes learns the hashes of the candidate chunks a range at a time, the ranges are pipelined on the
+// peer sessions. chunks of a range no peer could send still get a proof request of their own in chunkLeaf
+func (cd *ChunkDownloader) fetchHashes(ctx context.Context, candidates []int) {
+	tree := cd.manifest.Tree()
+	var firsts []int
+	for _, i := range candidates {
+		first := i - i%reuseHashRange
+		if _, ok := tree.Leaf(i); ok || (len(firsts) > 0 && firsts[len(firsts)-1] == first) {
+			continue
+		}
+		firsts = append(firsts, first)
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, max(1, cd.workerLimit()))
+	for _, first := range firsts {
+		if ctx.Err() != nil {
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(first int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			cd.rangeHashes(ctx, first)
+		}(first)
+	}
+	wg.Wait()
+}
+
+// rangeHashes asks peers for the hashes of one range until one sends hashes that add up to the root
+func (cd *ChunkDownloader) rangeHashes(ctx context.Context, first int) {
+	for _, pi := range cd.scores.rank(cd.peerList(), cd.manifest.ChunkSize) {
+		leaves, proof, err := cd.session(pi).hashes(ctx, cd.manifest.FileID(), first, reuseHashRange)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+		if err := cd.manifest.Tree().VerifyRange(first, reuseHashRange, leaves, proof); err != nil {
+			log.Printf("Bad hashes for chunks %d+%d from %s: %v", first, len(leaves), pi.ID, err)
+			cd.scored(pi.ID, cd.scores.reject(pi.ID, err))
+			continue
+		}
+		return
+	}
+}
+
+// chunkLeaf returns the hash of a chunk in the new content, asking peers for its proof unless the tree knows it already.
+// after fetchHashes it usually does
+func (cd *ChunkDownloader) chunkLeaf(ctx context.Context, chunkID int) ([32]byte, bool) {
+	tree := cd.manifest.Tree()
+	if leaf, ok := tree.Leaf(chunkID); ok {
+		return leaf, true
+	}
+
+	for _, pi := range cd.scores.rank(cd.peerList(), cd.manifest.ChunkSize) {
+		leaf, proof, err := cd.session(pi).proof(ctx, cd.manifest.FileID(), chunkID)
+		if err != nil {
+			if ctx.Err() != nil {
+				return leaf, false
+			}
+			continue
+		}
+		if err := tree.Verify(chunkID, leaf, proof); err != nil {
+			log.Printf("Bad proof for chunk %d from %s: %v", chunkID, pi.ID, err)
+			cd.scored(pi.ID, cd.scores.reject(pi.ID, err))
+			continue
+		}
+		return leaf, true
+	}
+	return [32]byte{}, false
+}
+
+// samePath reports whether two paths point at the same file, a missing path is never the same
+func samePath(a, b string) (bool, error) {
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false, fmt.Errorf("failed to get info about %s: %w", a, err)
+	}
+	bi, err := os.Stat(b)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get info about %s: %w", b, err)
+	}
+	return os.SameFile(ai, bi), nil
+}
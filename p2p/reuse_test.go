@@ -0,0 +1,140 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/srivatsa-bot/bt-p2p/files"
+)
+
+func TestReuseFrom(t *testing.T) {
+	ctx := context.Background()
+	d := t.TempDir()
+	oldPath := filepath.Join(d, "old.bin")
+	oldData := writeTestFile(t, oldPath, 12*1024*1024)
+
+	// the new version has bytes inserted in the middle and one changed near the end
+	ins := make([]byte, 1000)
+	rand.Read(ins)
+	newData := append(append(append([]byte{}, oldData[:5*1024*1024]...), ins...), oldData[5*1024*1024:]...)
+	newData[len(newData)-100] ^= 0xff
+	src := filepath.Join(d, "src.bin")
+	if err := os.WriteFile(src, newData, 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := files.BuildManifestCDC(src, files.DefaultCDCParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seeder := newTestHost(t)
+	reg := NewRegistry()
+	shareTestFile(t, seeder, reg, src, m)
+	HandleFileRequest(seeder, reg)
+	peers := []peer.AddrInfo{{ID: seeder.ID(), Addrs: seeder.Addrs()}}
+
+	out := filepath.Join(d, "out.bin")
+	pm := partialManifest(t, m)
+	c, err := files.CreateContent(out, pm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	cd := NewChunkDownloader(newTestHost(t), peers, c, pm)
+
+	if _, err := cd.ReuseFrom(ctx, out); err == nil {
+		t.Error("reusing the output itself was accepted")
+	}
+	reused, err := cd.ReuseFrom(ctx, oldPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the chunks around the two edits differ
+	if reused < m.ChunkCount()-4 {
+		t.Errorf("reused %d of %d chunks", reused, m.ChunkCount())
+	}
+	// reused chunks keep their proofs so they can be re-served
+	for i := 0; i < m.ChunkCount(); i++ {
+		if _, ok := pm.Tree().Proof(i); cd.isDownloaded(i) && !ok {
+			t.Errorf("reused chunk %d has no proof", i)
+		}
+	}
+
+	if err := cd.DownloadChunksParallel(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := cd.VerifyFile(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, newData) {
+		t.Fatal("download does not match the new version")
+	}
+	if n := cd.BytesDownloaded(); n > 4*int64(files.DefaultCDCParams.Max) {
+		t.Errorf("fetched %d bytes, more than the changed chunks", n)
+	}
+}
+
+func TestFetchHashes(t *testing.T) {
+	ctx := context.Background()
+	d := t.TempDir()
+	src := filepath.Join(d, "src.bin")
+	writeTestFile(t, src, 9*files.ChunkSize)
+	m, err := files.BuildManifest(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		full bool // seeder has the whole tree, else it only knows the proof of chunk 0
+	}{
+		{"seeder with the whole tree", true},
+		{"seeder without the range", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			served := m
+			if !tt.full {
+				served = partialManifest(t, m)
+				proof, _ := m.Tree().Proof(0)
+				leaf, _ := m.Tree().Leaf(0)
+				if err := served.Tree().Verify(0, leaf, proof); err != nil {
+					t.Fatal(err)
+				}
+			}
+			seeder := newTestHost(t)
+			reg := NewRegistry()
+			shareTestFile(t, seeder, reg, src, served)
+			HandleFileRequest(seeder, reg)
+			peers := []peer.AddrInfo{{ID: seeder.ID(), Addrs: seeder.Addrs()}}
+
+			pm := partialManifest(t, m)
+			c, err := files.CreateContent(filepath.Join(t.TempDir(), "out.bin"), pm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			cd := NewChunkDownloader(newTestHost(t), peers, c, pm)
+
+			cd.fetchHashes(ctx, []int{0, 3, 8})
+			for i := 0; i < m.ChunkCount(); i++ {
+				if _, ok := pm.Tree().Leaf(i); ok != tt.full {
+					t.Errorf("chunk %d: hash known %v, want %v", i, ok, tt.full)
+				}
+			}
+			// without a range the chunk is still proven on its own
+			if _, ok := cd.chunkLeaf(ctx, 0); !ok {
+				t.Error("chunk 0 could not be proven")
+			}
+		})
+	}
+}
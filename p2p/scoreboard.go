@@ -0,0 +1,295 @@
+// keeps track of how each peer performs during a download so chunks go to the fastest healthy peers
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/srivatsa-bot/bt-p2p/files"
+)
+
+// weight of a new sample in the moving averages
+const scoreSmoothing = 0.3
+
+// peers nothing is known about yet are assumed this fast so they get tried early
+const assumedThroughput = 4 * 1024 * 1024
+
+// cooldown after a failed request, doubles with every failure in a row
+const (
+	minPeerCooldown = 2 * time.Second
+	maxPeerCooldown = 2 * time.Minute
+)
+
+// a peer failing this many requests in a row is taken as gone until discovery finds it again
+const maxPeerFailures = 5
+
+// why end dropped a peer
+const (
+	peerKept   = iota
+	peerBanned // sent corrupt data
+	peerGone   // too many failures in a row
+	peerV1Only // only speaks v1, its chunks come without proofs
+)
+
+// peerScore is what we learned about one peer
+type peerScore struct {
+	throughput   float64       // bytes per second, moving average over chunk transfers
+	latency      time.Duration // moving average of small request round trips
+	inFlight     int
+	chunks       int // chunks fetched and verified
+	errors       int // failed requests, not counting corrupt data
+	hashFailures int
+	streak       int // failures in a row
+	cooldown     time.Time
+	banned       bool
+	gone         bool
+	v1Only       bool // never asked again, discovery finding it does not help
+}
+
+// scoreboard ranks peers by how soon they are expected to deliver a chunk.
+// failing peers are pushed back with an exponential cooldown, peers that send corrupt data are banned for the session
+type scoreboard struct {
+	mu    sync.Mutex
+	peers map[peer.ID]*peerScore
+}
+
+func newScoreboard() *scoreboard {
+	return &scoreboard{peers: make(map[peer.ID]*peerScore)}
+}
+
+// get returns the score of a peer, creating it on first use. called with sb.mu held
+func (sb *scoreboard) get(id peer.ID) *peerScore {
+	ps, ok := sb.peers[id]
+	if !ok {
+		ps = &peerScore{}
+		sb.peers[id] = ps
+	}
+	return ps
+}
+
+// begin marks a chunk request to a peer as started, pass the result to end
+func (sb *scoreboard) begin(id peer.ID) time.Time {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	sb.get(id).inFlight++
+	return time.Now()
+}
+
+// end records how a chunk request went. returns peerBanned or peerGone when this request got the peer dropped
+func (sb *scoreboard) end(id peer.ID, start time.Time, n int, err error) int {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	ps := sb.get(id)
+	ps.inFlight--
+
+	if err == nil {
+		elapsed := time.Since(start).Seconds()
+		if elapsed > 0 {
+			ps.throughput = smooth(ps.throughput, float64(n)/elapsed)
+		}
+		ps.chunks++
+		ps.streak = 0
+		ps.cooldown = time.Time{}
+		return peerKept
+	}
+	return ps.fail(err)
+}
+
+// reject records a reply that failed verification outside a chunk request, like chunk hashes or a proof
+// asked for while reusing chunks. it counts the same as a chunk that failed that way
+func (sb *scoreboard) reject(id peer.ID, err error) int {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.get(id).fail(err)
+}
+
+// fail records a request that went wrong, corrupt data bans the peer and other errors cool it down.
+// returns why the peer got dropped if this did it. called with sb.mu held
+func (ps *peerScore) fail(err error) int {
+	switch {
+	case errors.Is(err, files.ErrHashMismatch):
+		ps.hashFailures++
+		if !ps.banned {
+			ps.banned = true
+			return peerBanned
+		}
+	case errors.Is(err, errV1Only):
+		if !ps.v1Only {
+			ps.v1Only = true
+			return peerV1Only
+		}
+	case errors.Is(err, files.ErrNoProof):
+		// a peer without the proof of a chunk it has can not serve this file
+		if !ps.gone {
+			ps.gone = true
+			return peerGone
+		}
+	case errors.Is(err, context.Canceled), errors.Is(err, ErrNotHave):
+		// lost an endgame race or the bitfield was stale, not the peers fault
+	default:
+		ps.errors++
+		ps.streak++
+		backoff := minPeerCooldown << min(ps.streak-1, 16)
+		if backoff > maxPeerCooldown {
+			backoff = maxPeerCooldown
+		}
+		ps.cooldown = time.Now().Add(backoff)
+		if ps.streak >= maxPeerFailures && !ps.gone {
+			ps.gone = true
+			return peerGone
+		}
+	}
+	return peerKept
+}
+
+// revive gives a gone peer a fresh start after discovery found it again. banned peers stay banned
+func (sb *scoreboard) revive(id peer.ID) bool {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	ps, ok := sb.peers[id]
+	if !ok || !ps.gone || ps.banned || ps.v1Only {
+		return false
+	}
+	ps.gone = false
+	ps.streak = 0
+	ps.cooldown = time.Time{}
+	return true
+}
+
+// latencySample records the round trip of a small request like a bitfield
+func (sb *scoreboard) latencySample(id peer.ID, rtt time.Duration) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	ps := sb.get(id)
+	ps.latency = time.Duration(smooth(float64(ps.latency), float64(rtt)))
+}
+
+// markV1Only records a peer that only speaks v1, returns false when that was known already
+func (sb *scoreboard) markV1Only(id peer.ID) bool {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	ps := sb.get(id)
+	if ps.v1Only {
+		return false
+	}
+	ps.v1Only = true
+	return true
+}
+
+// isCooling reports whether a peer is waiting out a cooldown after failures
+func (sb *scoreboard) isCooling(id peer.ID) bool {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	ps, ok := sb.peers[id]
+	return ok && time.Now().Before(ps.cooldown)
+}
+
+// isDropped reports whether a peer is banned, gone or only speaks v1
+func (sb *scoreboard) isDropped(id peer.ID) bool {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	ps, ok := sb.peers[id]
+	return ok && ps.dropped()
+}
+
+func (ps *peerScore) dropped() bool {
+	return ps.banned || ps.gone || ps.v1Only
+}
+
+// active counts the peers that are neither dropped nor cooling down
+func (sb *scoreboard) active(peers []peer.AddrInfo) int {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	now := time.Now()
+	n := 0
+	for _, pi := range peers {
+		ps := sb.get(pi.ID)
+		if !ps.dropped() && !now.Before(ps.cooldown) {
+			n++
+		}
+	}
+	return n
+}
+
+// rank returns the peers worth asking for a chunk, best first. dropped peers are left out
+// and peers cooling down after failures come last so they are only asked when nobody else can serve
+func (sb *scoreboard) rank(peers []peer.AddrInfo, chunkSize int) []peer.AddrInfo {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	now := time.Now()
+	type ranked struct {
+		info    peer.AddrInfo
+		cost    float64
+		cooling bool
+	}
+	list := make([]ranked, 0, len(peers))
+	for _, pi := range peers {
+		ps := sb.get(pi.ID)
+		if ps.dropped() {
+			continue
+		}
+		list = append(list, ranked{info: pi, cost: ps.cost(chunkSize), cooling: now.Before(ps.cooldown)})
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].cooling != list[j].cooling {
+			return !list[i].cooling
+		}
+		return list[i].cost < list[j].cost
+	})
+
+	out := make([]peer.AddrInfo, len(list))
+	for i, r := range list {
+		out[i] = r.info
+	}
+	return out
+}
+
+// cost is the expected seconds until this peer delivers one more chunk, queued requests
+// included, scaled up by how often requests to it fail
+func (ps *peerScore) cost(chunkSize int) float64 {
+	throughput := ps.throughput
+	if throughput == 0 {
+		throughput = assumedThroughput
+	}
+	seconds := ps.latency.Seconds() + float64(ps.inFlight+1)*float64(chunkSize)/throughput
+	successRate := float64(ps.chunks+1) / float64(ps.chunks+ps.errors+1)
+	return seconds / successRate
+}
+
+// summary describes every peer that was asked for anything, for the end of download log
+func (sb *scoreboard) summary() []string {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	var lines []string
+	for id, ps := range sb.peers {
+		if ps.chunks == 0 && ps.errors == 0 && ps.hashFailures == 0 {
+			continue
+		}
+		line := fmt.Sprintf("%s: %d chunks, %.2f MB/s, %v latency, %d errors", id, ps.chunks, ps.throughput/(1024*1024), ps.latency.Round(time.Millisecond), ps.errors)
+		if ps.banned {
+			line += fmt.Sprintf(", banned after %d corrupt chunk(s)", ps.hashFailures)
+		} else if ps.v1Only {
+			line += ", only speaks v1"
+		} else if ps.gone {
+			line += ", gone"
+		}
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// exponential moving average, the first sample is taken as is
+func smooth(avg, sample float64) float64 {
+	if avg == 0 {
+		return sample
+	}
+	return avg + scoreSmoothing*(sample-avg)
+}
@@ -0,0 +1,119 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/srivatsa-bot/bt-p2p/files"
+)
+
+// failRequests runs n chunk requests to id that all end with err and returns the result of the last
+func failRequests(sb *scoreboard, id peer.ID, n int, err error) int {
+	result := peerKept
+	for i := 0; i < n; i++ {
+		result = sb.end(id, sb.begin(id), 0, err)
+	}
+	return result
+}
+
+func TestScoreboardFailures(t *testing.T) {
+	timeout := errors.New("timeout")
+	tests := []struct {
+		name    string
+		err     error
+		n       int
+		result  int
+		cooling bool
+		dropped bool
+		revived bool
+	}{
+		{"one failure cools down", timeout, 1, peerKept, true, false, false},
+		{"failures in a row make it gone", timeout, maxPeerFailures, peerGone, true, true, true},
+		{"corrupt data bans", fmt.Errorf("chunk 3: %w", files.ErrHashMismatch), 1, peerBanned, false, true, false},
+		{"v1 peers are dropped for good", errV1Only, 1, peerV1Only, false, true, false},
+		{"missing proofs make it gone", files.ErrNoProof, 1, peerGone, false, true, true},
+		{"lost races do not count", context.Canceled, maxPeerFailures, peerKept, false, false, false},
+		{"stale bitfields do not count", ErrNotHave, maxPeerFailures, peerKept, false, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sb := newScoreboard()
+			if got := failRequests(sb, "a", tt.n, tt.err); got != tt.result {
+				t.Errorf("result %d, want %d", got, tt.result)
+			}
+			if got := sb.isCooling("a"); got != tt.cooling {
+				t.Errorf("cooling %v, want %v", got, tt.cooling)
+			}
+			if got := sb.isDropped("a"); got != tt.dropped {
+				t.Errorf("dropped %v, want %v", got, tt.dropped)
+			}
+			if got := sb.revive("a"); got != tt.revived {
+				t.Errorf("revived %v, want %v", got, tt.revived)
+			}
+			if tt.revived && (sb.isDropped("a") || sb.isCooling("a")) {
+				t.Error("revived peer is still dropped or cooling down")
+			}
+		})
+	}
+}
+
+func TestScoreboardCooldownBackoff(t *testing.T) {
+	sb := newScoreboard()
+	var last time.Duration
+	for i := 1; i < maxPeerFailures; i++ {
+		failRequests(sb, "a", 1, errors.New("timeout"))
+		cooldown := time.Until(sb.peers["a"].cooldown)
+		if cooldown <= last || cooldown > maxPeerCooldown {
+			t.Fatalf("cooldown %v after %d failures, was %v", cooldown, i, last)
+		}
+		last = cooldown
+	}
+
+	// a chunk that arrives ends the streak
+	sb.end("a", sb.begin("a"), files.ChunkSize, nil)
+	if sb.isCooling("a") || sb.peers["a"].streak != 0 {
+		t.Fatal("success did not clear the cooldown")
+	}
+}
+
+func TestScoreboardReject(t *testing.T) {
+	sb := newScoreboard()
+	if got := sb.reject("a", fmt.Errorf("chunk hashes: %w", files.ErrHashMismatch)); got != peerBanned {
+		t.Fatalf("rejected hashes gave %d, want banned", got)
+	}
+	if got := sb.reject("a", files.ErrHashMismatch); got != peerKept {
+		t.Fatalf("second rejection gave %d, the peer was banned already", got)
+	}
+	if sb.revive("a") {
+		t.Fatal("banned peer was revived")
+	}
+	if sb.peers["a"].inFlight != 0 {
+		t.Fatal("reject counted as a request")
+	}
+}
+
+func TestScoreboardRank(t *testing.T) {
+	sb := newScoreboard()
+	peers := []peer.AddrInfo{{ID: "slow"}, {ID: "cooling"}, {ID: "fast"}, {ID: "banned"}, {ID: "new"}}
+
+	sb.peers["slow"] = &peerScore{throughput: 1024 * 1024}
+	sb.peers["fast"] = &peerScore{throughput: 64 * 1024 * 1024}
+	failRequests(sb, "cooling", 1, errors.New("timeout"))
+	sb.reject("banned", files.ErrHashMismatch)
+
+	var got []peer.ID
+	for _, pi := range sb.rank(peers, files.ChunkSize) {
+		got = append(got, pi.ID)
+	}
+	want := []peer.ID{"fast", "new", "slow", "cooling"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("ranked %v, want %v", got, want)
+	}
+	if n := sb.active(peers); n != 3 {
+		t.Fatalf("%d active peers, want 3", n)
+	}
+}
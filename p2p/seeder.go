@@ -3,28 +3,235 @@ package p2p
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/fatih/color"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/srivatsa-bot/bt-p2p/files"
 )
 
-// Runs on seeder side, listens for incomming requests using the mentioned protocol
-func HandleFileRequest(h host.Host, filePath string) error {
-	// Check if file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		return fmt.Errorf("file does not exist: %s", filePath)
+// Seeder serves any number of files from one host, each announced under its own file id
+type Seeder struct {
+	host       host.Host
+	kad        *dht.IpfsDHT
+	registry   *Registry
+	reprovider *Reprovider
+	cdc        *files.CDCParams // content defined chunking for added files, nil for fixed size chunks
+	store      *files.Store     // added files are imported and served from here when set
+}
+
+// Creates a seeder and registers the chunk and manifest handlers on the host.
+// Every added file is re-announced roughly every reprovideInterval until ctx is cancelled
+func NewSeeder(ctx context.Context, h host.Host, kad *dht.IpfsDHT, reprovideInterval time.Duration) (*Seeder, error) {
+	s := &Seeder{
+		host:       h,
+		kad:        kad,
+		registry:   NewRegistry(),
+		reprovider: NewReprovider(ctx, kad, reprovideInterval),
 	}
 
-	h.SetStreamHandler(ProtocolID, func(s network.Stream) {
+	if err := HandleFileRequest(h, s.registry); err != nil {
+		return nil, fmt.Errorf("failed to setup file handler: %w", err)
+	}
+	if err := HandleManifestRequest(h, s.registry); err != nil {
+		return nil, fmt.Errorf("failed to setup manifest handler: %w", err)
+	}
+	return s, nil
+}
+
+// Starts serving a file or directory and announces it, safe to call while seeding
+func (s *Seeder) Add(ctx context.Context, path string) (*SharedFile, error) {
+	// Build manifest, this hashes every file and every chunk
+	var manifest *files.Manifest
+	var err error
+	if s.cdc != nil {
+		manifest, err = files.BuildManifestCDC(path, *s.cdc)
+	} else {
+		manifest, err = files.BuildManifest(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to build manifest: %w", err)
+	}
+
+	signed, err := SignManifest(s.host, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	var content files.Source
+	content, err = files.OpenContent(path, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	// with a store the chunks are copied in once and the original files are not needed anymore
+	if s.store != nil {
+		err := s.store.Import(manifest, content)
+		content.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to import into store: %w", err)
+		}
+		if manifest, content, err = s.store.Open(manifest.FileID()); err != nil {
+			return nil, err
+		}
+	}
+
+	return s.serve(ctx, path, manifest, content, signed)
+}
+
+// Serves a file that is already in the store, by its file id
+func (s *Seeder) AddFromStore(ctx context.Context, fileID string) (*SharedFile, error) {
+	if s.store == nil {
+		return nil, fmt.Errorf("seeder has no store")
+	}
+	id, err := files.ParseFileID(fileID)
+	if err != nil {
+		return nil, err
+	}
+	manifest, content, err := s.store.Open(id.String())
+	if err != nil {
+		return nil, err
+	}
+	signed, err := SignManifest(s.host, manifest)
+	if err != nil {
+		content.Close()
+		return nil, err
+	}
+	return s.serve(ctx, manifest.Name, manifest, content, signed)
+}
+
+// registers a complete file and announces it, content is closed on failure
+func (s *Seeder) serve(ctx context.Context, path string, manifest *files.Manifest, content files.Source, signed *SignedManifest) (*SharedFile, error) {
+	f, err := NewSharedFile(path, manifest, content, signed)
+	if err != nil {
+		content.Close()
+		return nil, err
+	}
+
+	if err := s.registry.Add(f); err != nil {
+		content.Close()
+		return nil, err
+	}
+
+	// without DHT peers the file is still served to peers that find it another way, like mdns or a share link
+	if err := AnnounceFile(ctx, s.kad, f.ID); err != nil {
+		log.Printf("%s %v", color.YellowString("Not announced on the DHT yet, retrying in the background:"), err)
+		s.reprovider.AddUnannounced(f.ID)
+		return f, nil
+	}
+	s.reprovider.Add(f.ID)
+	return f, nil
+}
+
+// SetChunking makes files added after this use content defined chunking, nil goes back to fixed size chunks
+func (s *Seeder) SetChunking(p *files.CDCParams) {
+	s.cdc = p
+}
+
+// SetACL limits which peers get manifests and chunks, nil serves everyone
+func (s *Seeder) SetACL(acl *ACL) {
+	s.registry.SetACL(acl)
+}
+
+// SetStore makes files added after this get imported into the chunk store and served from it
+func (s *Seeder) SetStore(store *files.Store) {
+	s.store = store
+}
+
+// Serves the chunks of a download in progress. The manifest is signed again with this hosts key since
+// leechers check it against the peer they got it from, the file id still ties it to the content.
+// The file is only announced once it holds at least one chunk. The content stays the download's,
+// Remove refuses the file until EndPartial hands it over or stops serving it
+func (s *Seeder) AddPartial(ctx context.Context, path string, manifest *files.Manifest, content *files.Content, have files.Bitfield) (*SharedFile, error) {
+	signed, err := SignManifest(s.host, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := NewSharedFile(path, manifest, content, signed)
+	if err != nil {
+		return nil, err
+	}
+	f.have = append(files.Bitfield(nil), have...)
+	f.partial = true
+
+	if err := s.registry.Add(f); err != nil {
+		return nil, err
+	}
+
+	if have.Count() > 0 {
+		s.announcePartial(ctx, f)
+	}
+	return f, nil
+}
+
+// EndPartial is called once the download behind a file from AddPartial stops. With keep the seeder takes over
+// the content and serves it like an added file, otherwise it stops serving it and the download closes the content
+func (s *Seeder) EndPartial(f *SharedFile, keep bool) {
+	if keep {
+		f.mu.Lock()
+		f.partial = false
+		f.mu.Unlock()
+		return
+	}
+	s.registry.removePartial(f)
+	s.reprovider.Remove(f.ID)
+	log.Printf("%s %s", color.RedString("Stopped seeding file:"), f.ID)
+}
+
+// Makes a newly verified chunk servable, the first chunk also announces the file
+func (s *Seeder) MarkHave(ctx context.Context, f *SharedFile, chunkID int) {
+	if f.markHave(chunkID) {
+		go s.announcePartial(ctx, f)
+	}
+}
+
+// announces a partially downloaded file, failures are only logged since the download goes on regardless
+func (s *Seeder) announcePartial(ctx context.Context, f *SharedFile) {
+	if err := AnnounceFile(ctx, s.kad, f.ID); err != nil {
+		log.Printf("Failed to announce partial file %s: %v", f.ID, err)
+		s.reprovider.AddUnannounced(f.ID)
+		return
+	}
+	s.reprovider.Add(f.ID)
+}
+
+// Stops serving a file, its provider record expires on its own
+func (s *Seeder) Remove(fileID string) error {
+	if err := s.registry.Remove(fileID); err != nil {
+		return err
+	}
+	s.reprovider.Remove(fileID)
+	log.Printf("%s %s", color.RedString("Stopped seeding file:"), fileID)
+	return nil
+}
 
+// Files currently being served
+func (s *Seeder) Files() []*SharedFile {
+	return s.registry.List()
+}
+
+// Runs on seeder side, listens for incomming requests on both protocol versions.
+// libp2p negotiates the version, so old leechers keep talking v1 and new ones get v2
+func HandleFileRequest(h host.Host, reg *Registry) error {
+	h.SetStreamHandler(ProtocolIDv2, func(s network.Stream) {
+		handleStreamV2(s, reg)
+	})
+
+	// v1: leecher sends "<file_id> <chunk_id>\n", a bare chunk id is still accepted when only one file is served
+	h.SetStreamHandler(ProtocolID, func(s network.Stream) {
+		if !reg.permits(s) {
+			return
+		}
 		defer s.Close()
 		log.Printf("%s %s", color.BlueString("Incoming stream from:"), s.Conn().RemotePeer())
 
@@ -32,37 +239,37 @@ func HandleFileRequest(h host.Host, filePath string) error {
 		s.SetReadDeadline(time.Now().Add(30 * time.Second))
 
 		reader := bufio.NewReader(s)
-		chunkReq, err := reader.ReadString('\n') //read till newline to get chunkid send by the leecher
+		chunkReq, err := reader.ReadString('\n') //read till newline to get file id and chunk id send by the leecher
 		if err != nil {
 			log.Printf("Failed to read chunk request: %v", err)
 			return
 		}
-		chunkReq = strings.TrimSpace(chunkReq) //remove newline
+		fields := strings.Fields(chunkReq)
 
-		file, err := os.Open(filePath)
-		if err != nil {
-			log.Printf("File open error: %v", err)
-			return
+		var (
+			file *SharedFile
+			ok   bool
+		)
+		switch len(fields) {
+		case 1:
+			file, ok = reg.only()
+		case 2:
+			file, ok = reg.Get(fields[0])
+			fields = fields[1:]
 		}
-		defer file.Close()
-
-		chunkID, err := strconv.Atoi(chunkReq)
-		if err != nil {
-			log.Printf("Invalid chunk ID: %s", chunkReq)
+		if !ok {
+			log.Printf("Chunk requested for unknown file: %q", strings.TrimSpace(chunkReq))
 			return
 		}
 
-		//moves file pointer based on chunk id
-		offset := int64(chunkID) * 512 * 1024
-		if _, err := file.Seek(offset, 0); err != nil {
-			log.Printf("Seek error: %v", err)
+		chunkID, err := strconv.Atoi(fields[0])
+		if err != nil {
+			log.Printf("Invalid chunk ID: %s", fields[0])
 			return
 		}
 
-		//read chunk into buffer
-		buf := make([]byte, 512*1024)
-		n, err := file.Read(buf)
-		if err != nil && err != io.EOF {
+		data, err := file.ReadChunk(chunkID)
+		if err != nil {
 			log.Printf("Read error: %v", err)
 			return
 		}
@@ -70,62 +277,150 @@ func HandleFileRequest(h host.Host, filePath string) error {
 		// Set write deadline
 		s.SetWriteDeadline(time.Now().Add(30 * time.Second))
 
-		//In last chunk we may send garbage insted of acutal data, so we write until then actual length of data in 512kb buffer
-		if _, err := s.Write(buf[:n]); err != nil {
+		if _, err := s.Write(data); err != nil {
 			log.Printf("Write error: %v", err)
 			return
 		}
 
-		log.Printf("%s %d (%d bytes)", color.BlueString("Send chunk:"), chunkID, n)
+		log.Printf("%s %s/%d (%d bytes)", color.BlueString("Send chunk:"), file.ID, chunkID, len(data))
 	})
 
 	return nil
 }
 
-// // Runs on leacher side, requests specific chunk from seeder
-// func RequestChunk(ctx context.Context, h host.Host, pi peer.AddrInfo, chunkID int, outFile *os.File) error {
-// 	// Connect to peer first
-// 	if err := h.Connect(ctx, pi); err != nil {
-// 		return fmt.Errorf("failed to connect to peer %s: %w", pi.ID, err)
-// 	}
-
-// 	// Create stream with timeout
-// 	streamCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
-// 	defer cancel()
-
-// 	s, err := h.NewStream(streamCtx, pi.ID, ProtocolID)
-// 	if err != nil {
-// 		return fmt.Errorf("stream creation failed: %w", err)
-// 	}
-// 	defer s.Close()
-
-// 	// Set deadlines
-// 	s.SetWriteDeadline(time.Now().Add(10 * time.Second))
-// 	s.SetReadDeadline(time.Now().Add(30 * time.Second))
-
-// 	// Send chunk request
-// 	if _, err := fmt.Fprintf(s, "%d\n", chunkID); err != nil {
-// 		return fmt.Errorf("failed to send chunk request: %w", err)
-// 	}
-
-// 	// Read response into buffer
-// 	buf := make([]byte, 512*1024)
-// 	n, err := io.ReadFull(s, buf)
-// 	if err != nil && err != io.ErrUnexpectedEOF {
-// 		return fmt.Errorf("failed to read chunk data: %w", err)
-// 	}
-
-// 	// Move pointer to offset
-// 	offset := int64(chunkID) * 512 * 1024
-// 	if _, err := outFile.Seek(offset, 0); err != nil {
-// 		return fmt.Errorf("failed to seek in output file: %w", err)
-// 	}
-
-// 	// Write the bytes from offset
-// 	if _, err := outFile.Write(buf[:n]); err != nil {
-// 		return fmt.Errorf("failed to write chunk to file: %w", err)
-// 	}
-
-// 	log.Printf("Received chunk %d (%d bytes)", chunkID, n)
-// 	return nil
-// }
+// how long a v2 stream may sit idle between requests before the seeder drops it
+const streamIdleTimeout = 2 * time.Minute
+
+// serves framed requests in a loop until the leecher closes the stream, answers go out in request order.
+// unlike v1 every failure is reported back with a status code
+func handleStreamV2(s network.Stream, reg *Registry) {
+	if !reg.permits(s) {
+		return
+	}
+	defer s.Close()
+	remote := s.Conn().RemotePeer()
+	log.Printf("%s %s", color.BlueString("Incoming stream from:"), remote)
+
+	for {
+		s.SetReadDeadline(time.Now().Add(streamIdleTimeout))
+
+		req, err := readRequest(s)
+		if err == io.EOF {
+			return // leecher is done with this stream
+		}
+		if err != nil {
+			log.Printf("Failed to read chunk request from %s: %v", remote, err)
+			return
+		}
+
+		resp := serveRequest(reg, req)
+
+		s.SetWriteDeadline(time.Now().Add(30 * time.Second))
+		if err := writeResponse(s, resp); err != nil {
+			log.Printf("Write error: %v", err)
+			return
+		}
+
+		if resp.Status == StatusOK && req.Type == msgBitfield {
+			log.Printf("%s %s to %s", color.BlueString("Send bitfield:"), req.FileID, remote)
+		} else if resp.Status == StatusOK && req.Type == msgProof {
+			log.Printf("%s %s/%d to %s", color.BlueString("Send proof:"), req.FileID, req.Chunk, remote)
+		} else if resp.Status == StatusOK && req.Type == msgHashes {
+			log.Printf("%s %s/%d+%d to %s", color.BlueString("Send hashes:"), req.FileID, req.Chunk, len(resp.Payload)/32, remote)
+		} else if resp.Status == StatusOK {
+			log.Printf("%s %s/%d (%d bytes)", color.BlueString("Send chunk:"), req.FileID, req.Chunk, len(resp.Payload))
+		} else {
+			log.Printf("Rejected request for %s/%d: %s", req.FileID, req.Chunk, resp.Payload)
+		}
+	}
+}
+
+// builds the response for a single request
+func serveRequest(reg *Registry, req wireRequest) wireResponse {
+	if req.Type != msgChunkRequest && req.Type != msgBitfield && req.Type != msgProof && req.Type != msgHashes {
+		return errorResponse(StatusBadRequest, "unsupported request type %d", req.Type)
+	}
+
+	file, ok := reg.Get(req.FileID)
+	if !ok {
+		return errorResponse(StatusUnknownFile, "unknown file %s", req.FileID)
+	}
+
+	if req.Type == msgBitfield {
+		return wireResponse{Status: StatusOK, Payload: file.Bitfield()}
+	}
+	if req.Type == msgProof {
+		return serveProof(file, int(req.Chunk))
+	}
+	if req.Type == msgHashes {
+		return serveHashes(file, int(req.Chunk), int(req.Length))
+	}
+
+	data, err := file.ReadChunk(int(req.Chunk))
+	if errors.Is(err, ErrOutOfRange) {
+		return errorResponse(StatusOutOfRange, "chunk %d past end of file", req.Chunk)
+	}
+	if errors.Is(err, ErrNotHave) {
+		return errorResponse(StatusNotHave, "chunk %d not downloaded yet", req.Chunk)
+	}
+	if err != nil {
+		log.Printf("Read error: %v", err)
+		return errorResponse(StatusIOError, "failed to read chunk %d", req.Chunk)
+	}
+
+	// offset and length pick a slice of the chunk, length 0 means the rest of it
+	start, end := int64(req.Offset), int64(len(data))
+	if req.Length > 0 {
+		end = start + int64(req.Length)
+	}
+	if start > int64(len(data)) || end > int64(len(data)) {
+		return errorResponse(StatusOutOfRange, "range %d+%d past end of chunk %d", req.Offset, req.Length, req.Chunk)
+	}
+
+	resp := wireResponse{Status: StatusOK, Payload: data[start:end]}
+	if start == 0 && end == int64(len(data)) {
+		// a partial seeder only learns proofs as it downloads, without one the leecher cant check the chunk
+		proof, ok := file.Manifest.Tree().Proof(int(req.Chunk))
+		if !ok {
+			return errorResponse(StatusNotHave, "no proof for chunk %d yet", req.Chunk)
+		}
+		sum := files.ChunkHash(data)
+		resp.Hash = sum[:]
+		resp.Proof = proof
+	}
+	return resp
+}
+
+// answers a proof request from the merkle tree, the chunk itself is not read
+func serveProof(file *SharedFile, chunkID int) wireResponse {
+	tree := file.Manifest.Tree()
+	if chunkID >= tree.Leaves() {
+		return errorResponse(StatusOutOfRange, "chunk %d past end of file", chunkID)
+	}
+	leaf, ok := tree.Leaf(chunkID)
+	proof, hasProof := tree.Proof(chunkID)
+	if !ok || !hasProof {
+		return errorResponse(StatusNotHave, "no proof for chunk %d yet", chunkID)
+	}
+	return wireResponse{Status: StatusOK, Hash: leaf[:], Proof: proof}
+}
+
+// answers a hashes request from the merkle tree, a partial seeder only has the ranges it fully verified
+func serveHashes(file *SharedFile, first, count int) wireResponse {
+	tree := file.Manifest.Tree()
+	if first >= tree.Leaves() {
+		return errorResponse(StatusOutOfRange, "chunk %d past end of file", first)
+	}
+	if count < 1 || count > maxHashRange || count&(count-1) != 0 || first%count != 0 {
+		return errorResponse(StatusBadRequest, "range %d+%d is not a subtree of at most %d chunks", first, count, maxHashRange)
+	}
+	leaves, proof, ok := tree.RangeProof(first, count)
+	if !ok {
+		return errorResponse(StatusNotHave, "no hashes for chunks %d+%d yet", first, count)
+	}
+	payload := make([]byte, 0, 32*len(leaves))
+	for _, leaf := range leaves {
+		payload = append(payload, leaf[:]...)
+	}
+	return wireResponse{Status: StatusOK, Proof: proof, Payload: payload}
+}
@@ -0,0 +1,326 @@
+// one long lived stream per peer with several chunk requests in flight on it,
+// saves a connect and protocol negotiation per chunk which hurts a lot on high latency links
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/srivatsa-bot/bt-p2p/files"
+)
+
+// requests in flight per peer unless the downloader is told otherwise
+const DefaultPipelineDepth = 4
+
+var (
+	errSessionClosed = errors.New("session closed")
+	errV1Only        = errors.New("peer only speaks v1")
+)
+
+// result of one pipelined request
+type sessionResult struct {
+	resp wireResponse
+	err  error
+}
+
+// peerSession sends requests to one peer. v2 peers get a single stream with up to depth
+// requests outstanding, the seeder answers in order so responses are matched first in first out.
+// v1 peers are only detected, they send chunks without proofs so nothing is fetched from them
+type peerSession struct {
+	host   host.Host
+	info   peer.AddrInfo
+	slots  chan struct{} // one token per outstanding request
+	mu     sync.Mutex    // guards pipe and v1, held while writing so request order matches queue order
+	pipe   *pipe
+	v1     bool
+	closed bool
+}
+
+// a single v2 stream and the queue of requests waiting for a response on it
+type pipe struct {
+	stream network.Stream
+	queued chan chan sessionResult
+}
+
+func newPeerSession(h host.Host, info peer.AddrInfo, depth int) *peerSession {
+	if depth < 1 {
+		depth = 1
+	}
+	return &peerSession{
+		host:  h,
+		info:  info,
+		slots: make(chan struct{}, depth),
+	}
+}
+
+// fetch gets one chunk and its merkle proof from the peer, blocks while depth requests are already outstanding.
+// v1 peers return errV1Only, chunks without a proof are never fetched since they could not be verified
+func (ps *peerSession) fetch(ctx context.Context, fileID string, chunkID int) ([]byte, files.MerkleProof, error) {
+	resp, err := ps.send(ctx, wireRequest{Type: msgChunkRequest, FileID: fileID, Chunk: uint32(chunkID)})
+	return resp.Payload, resp.Proof, err
+}
+
+// bitfield asks the peer which chunks of the file it has. v1 peers cant say, they return errV1Only
+func (ps *peerSession) bitfield(ctx context.Context, fileID string, chunks int) (files.Bitfield, error) {
+	resp, err := ps.send(ctx, wireRequest{Type: msgBitfield, FileID: fileID})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Payload) != len(files.NewBitfield(chunks)) {
+		return nil, fmt.Errorf("bitfield is %d bytes, expected %d", len(resp.Payload), len(files.NewBitfield(chunks)))
+	}
+	return files.Bitfield(resp.Payload), nil
+}
+
+// proof asks the peer for the hash of a chunk and its merkle proof, without the chunk data.
+// v1 peers cant send proofs, they return errV1Only
+func (ps *peerSession) proof(ctx context.Context, fileID string, chunkID int) ([32]byte, files.MerkleProof, error) {
+	var leaf [32]byte
+	resp, err := ps.send(ctx, wireRequest{Type: msgProof, FileID: fileID, Chunk: uint32(chunkID)})
+	if err != nil {
+		return leaf, nil, err
+	}
+	if len(resp.Hash) != len(leaf) {
+		return leaf, nil, fmt.Errorf("proof response has a %d byte hash", len(resp.Hash))
+	}
+	copy(leaf[:], resp.Hash)
+	return leaf, resp.Proof, nil
+}
+
+// hashes asks the peer for the hashes of count chunks from first on and the proof of their subtree,
+// see MerkleTree.RangeProof
+func (ps *peerSession) hashes(ctx context.Context, fileID string, first, count int) ([][32]byte, files.MerkleProof, error) {
+	resp, err := ps.send(ctx, wireRequest{Type: msgHashes, FileID: fileID, Chunk: uint32(first), Length: uint32(count)})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(resp.Payload)%32 != 0 {
+		return nil, nil, fmt.Errorf("hashes response has %d bytes, not a multiple of 32", len(resp.Payload))
+	}
+	leaves := make([][32]byte, len(resp.Payload)/32)
+	for i := range leaves {
+		copy(leaves[i][:], resp.Payload[32*i:])
+	}
+	return leaves, resp.Proof, nil
+}
+
+// send pipelines one v2 request on the peers stream and waits for its response
+func (ps *peerSession) send(ctx context.Context, req wireRequest) (wireResponse, error) {
+	select {
+	case ps.slots <- struct{}{}:
+	case <-ctx.Done():
+		return wireResponse{}, ctx.Err()
+	}
+
+	ps.mu.Lock()
+	if ps.closed {
+		ps.mu.Unlock()
+		<-ps.slots
+		return wireResponse{}, errSessionClosed
+	}
+	p, err := ps.ensurePipe(ctx)
+	if err != nil {
+		ps.mu.Unlock()
+		<-ps.slots
+		return wireResponse{}, err
+	}
+	if p == nil {
+		ps.mu.Unlock()
+		<-ps.slots
+		return wireResponse{}, errV1Only
+	}
+
+	// write and enqueue together so the queue order is the order the seeder sees
+	res := make(chan sessionResult, 1)
+	p.stream.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if err := writeRequest(p.stream, req); err != nil {
+		ps.mu.Unlock()
+		ps.breakPipe(p)
+		<-ps.slots
+		return wireResponse{}, fmt.Errorf("failed to send request: %w", err)
+	}
+	p.queued <- res
+	ps.mu.Unlock()
+
+	// slot is given back by the reader once the response is in, even if we stop waiting
+	select {
+	case r := <-res:
+		return r.resp, r.err
+	case <-ctx.Done():
+		return wireResponse{}, ctx.Err()
+	}
+}
+
+// opens the v2 stream if there is none yet. returns nil pipe when the peer only speaks v1.
+// called with ps.mu held
+func (ps *peerSession) ensurePipe(ctx context.Context) (*pipe, error) {
+	if ps.v1 {
+		return nil, nil
+	}
+	if ps.pipe != nil {
+		return ps.pipe, nil
+	}
+
+	s, err := openStream(ctx, ps.host, ps.info, ProtocolIDv2, ProtocolID)
+	if err != nil {
+		return nil, err
+	}
+	if s.Protocol() != ProtocolIDv2 {
+		s.Close()
+		ps.v1 = true
+		return nil, nil
+	}
+
+	p := &pipe{stream: s, queued: make(chan chan sessionResult, cap(ps.slots))}
+	ps.pipe = p
+	go ps.readLoop(p)
+	return p, nil
+}
+
+// reads responses in order and hands each to the request at the head of the queue
+func (ps *peerSession) readLoop(p *pipe) {
+	for res := range p.queued {
+		p.stream.SetReadDeadline(time.Now().Add(30 * time.Second))
+		resp, err := readResponse(p.stream)
+		if err != nil {
+			res <- sessionResult{err: fmt.Errorf("failed to read chunk data: %w", err)}
+			<-ps.slots
+			ps.breakPipe(p)
+			continue // breakPipe closed the queue, drain whats left
+		}
+
+		if err := resp.err(); err != nil {
+			res <- sessionResult{err: err}
+		} else if err := checkResponseHash(resp); err != nil {
+			res <- sessionResult{err: err}
+		} else {
+			res <- sessionResult{resp: resp}
+		}
+		<-ps.slots
+	}
+}
+
+// drops a broken stream, requests still queued on it fail and the next fetch opens a new one
+func (ps *peerSession) breakPipe(p *pipe) {
+	ps.mu.Lock()
+	if ps.pipe != p {
+		ps.mu.Unlock()
+		return
+	}
+	ps.pipe = nil
+	// no writer can enqueue on p anymore, so closing the queue is safe
+	close(p.queued)
+	ps.mu.Unlock()
+
+	p.stream.Reset()
+	failQueued(p, ps.slots)
+}
+
+// fails whatever is still queued on a dead pipe
+func failQueued(p *pipe, slots chan struct{}) {
+	for {
+		select {
+		case res, ok := <-p.queued:
+			if !ok {
+				return
+			}
+			res <- sessionResult{err: fmt.Errorf("stream to peer broke: %w", io.ErrUnexpectedEOF)}
+			<-slots
+		default:
+			return
+		}
+	}
+}
+
+// closes the stream, a session is not used again after this
+func (ps *peerSession) close() {
+	ps.mu.Lock()
+	ps.closed = true
+	p := ps.pipe
+	ps.mu.Unlock()
+
+	if p != nil {
+		ps.breakPipe(p)
+	}
+}
+
+// connects to the peer and opens a stream on the first protocol it supports
+func openStream(ctx context.Context, h host.Host, pi peer.AddrInfo, protos ...protocol.ID) (network.Stream, error) {
+	// Connect to peer with timeout
+	connectCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	if err := h.Connect(connectCtx, pi); err != nil {
+		return nil, fmt.Errorf("failed to connect to peer %s: %w", pi.ID, err)
+	}
+
+	// Create stream with timeout
+	streamCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	s, err := h.NewStream(streamCtx, pi.ID, protos...)
+	if err != nil {
+		return nil, fmt.Errorf("stream creation failed: %w", err)
+	}
+	return s, nil
+}
+
+// fetchChunkOnce gets one chunk and its proof on a stream of its own instead of the peers pipeline.
+// used for endgame duplicates, cancelling ctx resets the stream so the peer stops sending
+func fetchChunkOnce(ctx context.Context, h host.Host, pi peer.AddrInfo, fileID string, chunkID int) ([]byte, files.MerkleProof, error) {
+	s, err := openStream(ctx, h, pi, ProtocolIDv2, ProtocolID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer s.Close()
+	stop := context.AfterFunc(ctx, func() { s.Reset() })
+	defer stop()
+
+	if s.Protocol() != ProtocolIDv2 {
+		return nil, nil, errV1Only
+	}
+
+	s.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	s.SetReadDeadline(time.Now().Add(30 * time.Second))
+
+	if err := writeRequest(s, wireRequest{Type: msgChunkRequest, FileID: fileID, Chunk: uint32(chunkID)}); err != nil {
+		return nil, nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	s.CloseWrite()
+
+	resp, err := readResponse(s)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		return nil, nil, fmt.Errorf("failed to read chunk data: %w", err)
+	}
+	if err := resp.err(); err != nil {
+		return nil, nil, err
+	}
+	if err := checkResponseHash(resp); err != nil {
+		return nil, nil, err
+	}
+	return resp.Payload, resp.Proof, nil
+}
+
+// hash covers the chunk as the seeder read it, a mismatch means the data broke on the way
+func checkResponseHash(resp wireResponse) error {
+	// proof responses carry the hash of a chunk they do not send
+	if len(resp.Hash) == 0 || len(resp.Payload) == 0 {
+		return nil
+	}
+	sum := files.ChunkHash(resp.Payload)
+	if string(resp.Hash) != string(sum[:]) {
+		return fmt.Errorf("chunk does not match hash sent by peer: %w", files.ErrHashMismatch)
+	}
+	return nil
+}
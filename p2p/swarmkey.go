@@ -0,0 +1,54 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/libp2p/go-libp2p/core/pnet"
+)
+
+// Default location of the swarm key, next to the identity key. A key found there is used without asking
+func DefaultSwarmKeyPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find config directory: %w", err)
+	}
+	return filepath.Join(dir, "bt", "swarm.key"), nil
+}
+
+// GenerateSwarmKey makes a new pre-shared key, encoded as a swarm.key file like IPFS private networks use:
+//
+//	/key/swarm/psk/1.0.0/
+//	/base16/
+//	<64 hex chars>
+func GenerateSwarmKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate swarm key: %w", err)
+	}
+	return []byte("/key/swarm/psk/1.0.0/\n/base16/\n" + hex.EncodeToString(key) + "\n"), nil
+}
+
+// LoadSwarmKey reads a swarm.key file, only peers holding the same key can connect to a host using it
+func LoadSwarmKey(path string) (pnet.PSK, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read swarm key: %w", err)
+	}
+	psk, err := pnet.DecodeV1PSK(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read swarm key %s: %w", path, err)
+	}
+	return psk, nil
+}
+
+// SwarmKeyFingerprint is a short hash of the key to compare between machines without showing the key
+func SwarmKeyFingerprint(psk pnet.PSK) string {
+	sum := sha256.Sum256(psk)
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,209 @@
+// framed binary messages for /bt/file/2.0.0, every request and response carries its own length
+// so the leecher can tell a short read from an error reported by the seeder
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/srivatsa-bot/bt-p2p/files"
+)
+
+const ProtocolIDv2 = protocol.ID("/bt/file/2.0.0")
+
+// request types
+const (
+	msgChunkRequest uint8 = 1
+	msgBitfield     uint8 = 2 // which chunks of the file the peer has, chunk/offset/length are ignored
+	msgProof        uint8 = 3 // hash and merkle proof of a chunk without its data, offset/length are ignored
+	msgHashes       uint8 = 4 // hashes of length chunks from chunk on and the proof of their subtree, offset is ignored
+)
+
+// most chunk hashes one hashes request may ask for, the reply stays well below maxPayloadSize
+const maxHashRange = 1 << 16
+
+// response status codes
+const (
+	StatusOK          uint8 = 0
+	StatusUnknownFile uint8 = 1 // seeder does not serve this file id
+	StatusOutOfRange  uint8 = 2 // chunk index or offset is past the end of the file
+	StatusIOError     uint8 = 3 // seeder failed to read its own copy
+	StatusBadRequest  uint8 = 4 // malformed or unsupported request
+	StatusNotHave     uint8 = 5 // peer is still downloading and does not have this chunk yet
+)
+
+// upper bound on a response payload so a peer cant make us allocate forever, the largest payload is a whole chunk
+const maxPayloadSize = files.MaxChunkSize
+
+var (
+	ErrUnknownFile   = errors.New("peer does not serve this file")
+	ErrOutOfRange    = errors.New("chunk out of range")
+	ErrRemoteIO      = errors.New("peer failed to read chunk")
+	ErrBadRequest    = errors.New("peer rejected request")
+	ErrNotHave       = errors.New("peer does not have chunk yet")
+	ErrShortRead     = errors.New("short read")
+	errUnknownStatus = errors.New("unknown status code")
+)
+
+// Request frame:
+//
+//	type u8 | file id len u8 | file id | chunk u32 | offset u32 | length u32
+//
+// offset and length select part of the chunk, length 0 means up to the end of the chunk
+type wireRequest struct {
+	Type   uint8
+	FileID string
+	Chunk  uint32
+	Offset uint32
+	Length uint32
+}
+
+// Response frame:
+//
+//	status u8 | payload len u32 | hash len u8 | hash | proof len u8 | proof hashes, 32 bytes each | payload
+//
+// hash is the sha256 of the whole chunk and proof the merkle siblings from the chunk up to the root,
+// both are only sent when the whole chunk is returned.
+// a proof request gets the hash and proof with an empty payload, a hashes request gets the chunk hashes
+// as payload, 32 bytes each, and the proof of the subtree they make up.
+// for a bitfield request the payload is the bitfield. on a non OK status the payload is an error message
+type wireResponse struct {
+	Status  uint8
+	Hash    []byte
+	Proof   files.MerkleProof
+	Payload []byte
+}
+
+func writeRequest(w io.Writer, req wireRequest) error {
+	if len(req.FileID) > 255 {
+		return fmt.Errorf("file id too long: %d bytes", len(req.FileID))
+	}
+
+	buf := make([]byte, 0, 2+len(req.FileID)+12)
+	buf = append(buf, req.Type, uint8(len(req.FileID)))
+	buf = append(buf, req.FileID...)
+	buf = binary.BigEndian.AppendUint32(buf, req.Chunk)
+	buf = binary.BigEndian.AppendUint32(buf, req.Offset)
+	buf = binary.BigEndian.AppendUint32(buf, req.Length)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+func readRequest(r io.Reader) (wireRequest, error) {
+	var req wireRequest
+
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return req, err
+	}
+	req.Type = head[0]
+
+	id := make([]byte, head[1])
+	if _, err := io.ReadFull(r, id); err != nil {
+		return req, fmt.Errorf("failed to read file id: %w", err)
+	}
+	req.FileID = string(id)
+
+	var fields [12]byte
+	if _, err := io.ReadFull(r, fields[:]); err != nil {
+		return req, fmt.Errorf("failed to read request fields: %w", err)
+	}
+	req.Chunk = binary.BigEndian.Uint32(fields[0:4])
+	req.Offset = binary.BigEndian.Uint32(fields[4:8])
+	req.Length = binary.BigEndian.Uint32(fields[8:12])
+
+	return req, nil
+}
+
+func writeResponse(w io.Writer, resp wireResponse) error {
+	if len(resp.Hash) > 255 {
+		return fmt.Errorf("hash too long: %d bytes", len(resp.Hash))
+	}
+	if len(resp.Proof) > 255 {
+		return fmt.Errorf("proof too long: %d hashes", len(resp.Proof))
+	}
+
+	buf := make([]byte, 0, 7+len(resp.Hash)+32*len(resp.Proof)+len(resp.Payload))
+	buf = append(buf, resp.Status)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(resp.Payload)))
+	buf = append(buf, uint8(len(resp.Hash)))
+	buf = append(buf, resp.Hash...)
+	buf = append(buf, uint8(len(resp.Proof)))
+	for _, h := range resp.Proof {
+		buf = append(buf, h[:]...)
+	}
+	buf = append(buf, resp.Payload...)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+func readResponse(r io.Reader) (wireResponse, error) {
+	var resp wireResponse
+
+	var head [6]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return resp, fmt.Errorf("failed to read response header: %w", err)
+	}
+	resp.Status = head[0]
+	size := binary.BigEndian.Uint32(head[1:5])
+	if size > maxPayloadSize {
+		return resp, fmt.Errorf("payload of %d bytes is too large", size)
+	}
+
+	resp.Hash = make([]byte, head[5])
+	if _, err := io.ReadFull(r, resp.Hash); err != nil {
+		return resp, fmt.Errorf("failed to read hash: %w", err)
+	}
+
+	var proofLen [1]byte
+	if _, err := io.ReadFull(r, proofLen[:]); err != nil {
+		return resp, fmt.Errorf("failed to read proof length: %w", err)
+	}
+	resp.Proof = make(files.MerkleProof, proofLen[0])
+	for i := range resp.Proof {
+		if _, err := io.ReadFull(r, resp.Proof[i][:]); err != nil {
+			return resp, fmt.Errorf("failed to read proof: %w", err)
+		}
+	}
+
+	resp.Payload = make([]byte, size)
+	if n, err := io.ReadFull(r, resp.Payload); err != nil {
+		return resp, fmt.Errorf("%w: got %d of %d bytes: %v", ErrShortRead, n, size, err)
+	}
+	return resp, nil
+}
+
+// Turns a non OK response into an error the leecher can check with errors.Is
+func (resp wireResponse) err() error {
+	var base error
+	switch resp.Status {
+	case StatusOK:
+		return nil
+	case StatusUnknownFile:
+		base = ErrUnknownFile
+	case StatusOutOfRange:
+		base = ErrOutOfRange
+	case StatusIOError:
+		base = ErrRemoteIO
+	case StatusBadRequest:
+		base = ErrBadRequest
+	case StatusNotHave:
+		base = ErrNotHave
+	default:
+		base = fmt.Errorf("%w %d", errUnknownStatus, resp.Status)
+	}
+	if len(resp.Payload) > 0 {
+		return fmt.Errorf("%w: %s", base, resp.Payload)
+	}
+	return base
+}
+
+// Builds an error response with a short message for the leecher
+func errorResponse(status uint8, format string, args ...any) wireResponse {
+	return wireResponse{Status: status, Payload: []byte(fmt.Sprintf(format, args...))}
+}
@@ -0,0 +1,215 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/srivatsa-bot/bt-p2p/files"
+)
+
+// newTestHost starts a host listening on localhost, closed when the test ends
+func newTestHost(t *testing.T) host.Host {
+	t.Helper()
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+// writeTestFile writes size random bytes to path and returns them
+func writeTestFile(t *testing.T, path string, size int) []byte {
+	t.Helper()
+	data := make([]byte, size)
+	rand.Read(data)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// shareTestFile signs m with h and adds the content at path to reg
+func shareTestFile(t *testing.T, h host.Host, reg *Registry, path string, m *files.Manifest) *SharedFile {
+	t.Helper()
+	sm, err := SignManifest(h, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := files.OpenContent(path, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	f, err := NewSharedFile(path, m, c, sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.Add(f); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestRequestRoundTrip(t *testing.T) {
+	tests := []wireRequest{
+		{Type: msgChunkRequest, FileID: "bafkreigh2akiscaildcqabsyg3dfr6chu3fgpregiymsck7e7aqa4s52zy", Chunk: 7},
+		{Type: msgChunkRequest, FileID: "f", Chunk: 1, Offset: 100, Length: 4096},
+		{Type: msgBitfield, FileID: "f"},
+		{Type: msgHashes, FileID: "f", Chunk: 4096, Length: 4096},
+		{Type: 42, FileID: ""},
+	}
+	for _, want := range tests {
+		var buf bytes.Buffer
+		if err := writeRequest(&buf, want); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readRequest(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestResponseRoundTrip(t *testing.T) {
+	hash := files.ChunkHash([]byte("chunk"))
+	tests := []struct {
+		name string
+		resp wireResponse
+		err  error
+	}{
+		{"chunk", wireResponse{Status: StatusOK, Hash: hash[:], Proof: files.MerkleProof{hash, hash}, Payload: []byte("chunk")}, nil},
+		{"empty", wireResponse{Status: StatusOK}, nil},
+		{"unknown file", errorResponse(StatusUnknownFile, "unknown file x"), ErrUnknownFile},
+		{"out of range", errorResponse(StatusOutOfRange, "chunk 9 past end of file"), ErrOutOfRange},
+		{"io error", errorResponse(StatusIOError, "failed"), ErrRemoteIO},
+		{"bad request", errorResponse(StatusBadRequest, "unsupported"), ErrBadRequest},
+		{"not have", errorResponse(StatusNotHave, "not yet"), ErrNotHave},
+		{"unknown status", wireResponse{Status: 99}, errUnknownStatus},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeResponse(&buf, tt.resp); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readResponse(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Status != tt.resp.Status || !bytes.Equal(got.Hash, tt.resp.Hash) || !bytes.Equal(got.Payload, tt.resp.Payload) || len(got.Proof) != len(tt.resp.Proof) {
+				t.Fatalf("got %+v, want %+v", got, tt.resp)
+			}
+			if err := got.err(); !errors.Is(err, tt.err) || (err == nil) != (tt.err == nil) {
+				t.Errorf("err() = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestReadResponseLimits(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+	}{
+		{"payload too large", binary.BigEndian.AppendUint32([]byte{StatusOK}, maxPayloadSize+1)},
+		{"short header", []byte{StatusOK, 0}},
+		{"short payload", append(binary.BigEndian.AppendUint32([]byte{StatusOK}, 10), 0, 0, 'a')},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := readResponse(bytes.NewReader(tt.frame)); err == nil {
+				t.Error("frame was accepted")
+			}
+		})
+	}
+}
+
+func TestServeRequest(t *testing.T) {
+	d := t.TempDir()
+	src := filepath.Join(d, "src.bin")
+	data := writeTestFile(t, src, 5*files.ChunkSize+3)
+	m, err := files.BuildManifest(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := NewRegistry()
+	shareTestFile(t, newTestHost(t), reg, src, m)
+	id := m.FileID()
+
+	tests := []struct {
+		name    string
+		req     wireRequest
+		status  uint8
+		payload []byte // expected for OK responses
+	}{
+		{"chunk", wireRequest{Type: msgChunkRequest, FileID: id, Chunk: 1}, StatusOK, data[files.ChunkSize : 2*files.ChunkSize]},
+		{"last chunk", wireRequest{Type: msgChunkRequest, FileID: id, Chunk: 5}, StatusOK, data[5*files.ChunkSize:]},
+		{"part of a chunk", wireRequest{Type: msgChunkRequest, FileID: id, Chunk: 2, Offset: 10, Length: 20}, StatusOK, data[2*files.ChunkSize+10 : 2*files.ChunkSize+30]},
+		{"rest of a chunk", wireRequest{Type: msgChunkRequest, FileID: id, Chunk: 5, Offset: 1}, StatusOK, data[5*files.ChunkSize+1:]},
+		{"chunk past end", wireRequest{Type: msgChunkRequest, FileID: id, Chunk: 6}, StatusOutOfRange, nil},
+		{"range past end of chunk", wireRequest{Type: msgChunkRequest, FileID: id, Chunk: 5, Offset: 2, Length: 2}, StatusOutOfRange, nil},
+		{"unknown file", wireRequest{Type: msgChunkRequest, FileID: "x", Chunk: 0}, StatusUnknownFile, nil},
+		{"unknown type", wireRequest{Type: 42, FileID: id}, StatusBadRequest, nil},
+		{"bitfield", wireRequest{Type: msgBitfield, FileID: id}, StatusOK, []byte{0xfc}},
+		{"proof", wireRequest{Type: msgProof, FileID: id, Chunk: 2}, StatusOK, nil},
+		{"hashes of the whole tree", wireRequest{Type: msgHashes, FileID: id, Chunk: 0, Length: 4096}, StatusOK, nil},
+		{"hashes of a subtree", wireRequest{Type: msgHashes, FileID: id, Chunk: 4, Length: 2}, StatusOK, nil},
+		{"hashes not aligned", wireRequest{Type: msgHashes, FileID: id, Chunk: 1, Length: 2}, StatusBadRequest, nil},
+		{"hashes not a power of two", wireRequest{Type: msgHashes, FileID: id, Chunk: 0, Length: 3}, StatusBadRequest, nil},
+		{"hashes too many", wireRequest{Type: msgHashes, FileID: id, Chunk: 0, Length: 2 * maxHashRange}, StatusBadRequest, nil},
+		{"hashes past end", wireRequest{Type: msgHashes, FileID: id, Chunk: 8, Length: 8}, StatusOutOfRange, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := serveRequest(reg, tt.req)
+			if resp.Status != tt.status {
+				t.Fatalf("status %d (%s), want %d", resp.Status, resp.Payload, tt.status)
+			}
+			if tt.status != StatusOK {
+				return
+			}
+			if tt.req.Type == msgHashes {
+				// the hashes have to check out on a tree that only knows the root
+				leaves := make([][32]byte, len(resp.Payload)/32)
+				for i := range leaves {
+					copy(leaves[i][:], resp.Payload[32*i:])
+				}
+				tree := files.NewPartialMerkleTree(m.ChunkCount(), m.Tree().Root())
+				if err := tree.VerifyRange(int(tt.req.Chunk), int(tt.req.Length), leaves, resp.Proof); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if !bytes.Equal(resp.Payload, tt.payload) {
+				t.Fatalf("got %d bytes, want %d", len(resp.Payload), len(tt.payload))
+			}
+			if tt.req.Type != msgChunkRequest {
+				return
+			}
+
+			// only a whole chunk comes with its hash, and its proof has to check out on a tree that only knows the root
+			whole := tt.req.Offset == 0 && tt.req.Length == 0
+			if sum := files.ChunkHash(resp.Payload); whole != bytes.Equal(resp.Hash, sum[:]) {
+				t.Fatalf("hash %x for a request of the whole chunk=%v", resp.Hash, whole)
+			}
+			if !whole {
+				return
+			}
+			tree := files.NewPartialMerkleTree(m.ChunkCount(), m.Tree().Root())
+			if err := tree.Verify(int(tt.req.Chunk), files.ChunkHash(resp.Payload), resp.Proof); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}